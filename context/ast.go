@@ -0,0 +1,248 @@
+package context
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/adnsv/go-pandoc"
+)
+
+// Internal classes attached to elements synthesized by fixupAST.
+const (
+	classCiteGroup    = "panctx:cite"         // Span holding a group of single-citation Cite elements
+	classFigure       = "panctx:figure"       // Div holding the content of a Figure block
+	classCaption      = "panctx:caption"      // Div holding the caption of a Figure block
+	classShortCaption = "panctx:shortcaption" // Div holding the short caption of a Figure block
+)
+
+// keyColWidths is an internal table attribute holding the relative column widths.
+const keyColWidths = "panctx:colwidths"
+
+// fixupAST patches the raw Pandoc JSON tree in place, so that it can be loaded
+// with go-pandoc. The fixups are:
+//
+//   - Span elements have two fields, while go-pandoc expects three;
+//   - Cite elements hold a list of citations, while go-pandoc expects a single
+//     one; they are split into a Span that groups one Cite per citation;
+//   - citation modes are encoded as {"t": mode} objects, while go-pandoc
+//     expects plain strings;
+//   - go-pandoc ignores table column widths; they are copied into an internal
+//     table attribute that is picked up by setColWidths;
+//   - go-pandoc does not know the Figure block introduced in pandoc 3; figures
+//     are converted to a Div with the caption stored in nested Divs.
+func fixupAST(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = fixupAST(v[i])
+		}
+		return v
+
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = fixupAST(v[k])
+		}
+		t, _ := v["t"].(string)
+		c, _ := v["c"].([]interface{})
+		switch t {
+		case "Span":
+			if len(c) == 2 {
+				v["c"] = append(c, nil)
+			}
+		case "Cite":
+			if len(c) == 2 {
+				if cc, ok := c[0].([]interface{}); ok {
+					return citeGroup(cc)
+				}
+			}
+		case "Table":
+			if len(c) == 6 {
+				stashColWidths(c)
+			}
+		case "Figure":
+			if len(c) == 3 {
+				return figureDiv(c)
+			}
+		}
+		return v
+	}
+	return v
+}
+
+// citeGroup builds a Span containing one single-citation Cite element for each
+// of the given citations.
+func citeGroup(citations []interface{}) interface{} {
+	content := []interface{}{}
+	for _, c := range citations {
+		if m, ok := c.(map[string]interface{}); ok {
+			if mode, ok := m["citationMode"].(map[string]interface{}); ok {
+				m["citationMode"] = mode["t"]
+			}
+		}
+		content = append(content, map[string]interface{}{
+			"t": "Cite",
+			"c": []interface{}{c, []interface{}{}},
+		})
+	}
+	return map[string]interface{}{
+		"t": "Span",
+		"c": []interface{}{
+			[]interface{}{"", []interface{}{classCiteGroup}, []interface{}{}},
+			content,
+			nil,
+		},
+	}
+}
+
+// figureDiv converts the content of a Figure block (attributes, caption, and
+// blocks) to a Div with the classFigure class. The caption and the short caption
+// are stored in nested Divs at the beginning of the content.
+func figureDiv(figure []interface{}) interface{} {
+	attr, _ := figure[0].([]interface{})
+	if len(attr) != 3 {
+		attr = []interface{}{"", []interface{}{}, []interface{}{}}
+	}
+	classes, _ := attr[1].([]interface{})
+	attr[1] = append(classes, classFigure)
+
+	blocks := []interface{}{}
+	div := func(class string, content []interface{}) interface{} {
+		return map[string]interface{}{
+			"t": "Div",
+			"c": []interface{}{
+				[]interface{}{"", []interface{}{class}, []interface{}{}},
+				content,
+			},
+		}
+	}
+	if caption, ok := figure[1].([]interface{}); ok && len(caption) == 2 {
+		if long, ok := caption[1].([]interface{}); ok && len(long) > 0 {
+			blocks = append(blocks, div(classCaption, long))
+		}
+		if short, ok := caption[0].([]interface{}); ok && len(short) > 0 {
+			blocks = append(blocks, div(classShortCaption, []interface{}{
+				map[string]interface{}{"t": "Plain", "c": short},
+			}))
+		}
+	}
+	content, _ := figure[2].([]interface{})
+	blocks = append(blocks, content...)
+
+	return map[string]interface{}{
+		"t": "Div",
+		"c": []interface{}{attr, blocks},
+	}
+}
+
+// stashColWidths copies the column widths of a table into an internal attribute.
+// Default widths are recorded as zeros.
+func stashColWidths(table []interface{}) {
+	attr, _ := table[0].([]interface{})
+	specs, _ := table[2].([]interface{})
+	if len(attr) != 3 {
+		return
+	}
+	kvs, _ := attr[2].([]interface{})
+	widths := []string{}
+	for _, spec := range specs {
+		w := 0.0
+		if spec, ok := spec.([]interface{}); ok && len(spec) == 2 {
+			if m, ok := spec[1].(map[string]interface{}); ok && m["t"] == "ColWidth" {
+				w, _ = m["c"].(float64)
+			}
+		}
+		widths = append(widths, strconv.FormatFloat(w, 'f', -1, 64))
+	}
+	attr[2] = append(kvs, []interface{}{keyColWidths, strings.Join(widths, ",")})
+}
+
+// setColWidths moves the column widths recorded by stashColWidths into the
+// table column specs.
+func setColWidths(table *pandoc.Table) {
+	kvs := table.Attr.KeyVals[:0]
+	for _, kv := range table.Attr.KeyVals {
+		if kv.Key != keyColWidths {
+			kvs = append(kvs, kv)
+			continue
+		}
+		for i, s := range strings.Split(kv.Val, ",") {
+			if i >= len(table.ColSpecs) {
+				break
+			}
+			if v, err := strconv.ParseFloat(s, 32); err == nil {
+				table.ColSpecs[i].ColWidth = float32(v)
+			}
+		}
+	}
+	table.Attr.KeyVals = kvs
+}
+
+// loadDocument parses a Pandoc JSON buffer and applies fixupAST to the blocks
+// and metadata.
+func loadDocument(jbuf []byte) (*pandoc.Document, error) {
+	d, err := pandoc.NewDocument(jbuf)
+	if err != nil {
+		return nil, err
+	}
+	d.Blocks, _ = fixupAST(d.Blocks).([]interface{})
+	for k, v := range d.Meta {
+		d.Meta[k] = fixupAST(v)
+	}
+	return d, nil
+}
+
+// metaInlines returns the inlines of a raw MetaInlines metadata value, which
+// keeps the formatting that ParseMeta drops.
+func metaInlines(raw interface{}) (pandoc.InlineList, bool) {
+	m, ok := raw.(map[string]interface{})
+	if !ok || m["t"] != "MetaInlines" {
+		return nil, false
+	}
+	d := &pandoc.Document{Blocks: []interface{}{map[string]interface{}{"t": "Plain", "c": m["c"]}}}
+	bb, err := d.Flow()
+	if err != nil || len(bb) != 1 {
+		return nil, false
+	}
+	p, ok := bb[0].(*pandoc.Plain)
+	if !ok {
+		return nil, false
+	}
+	return p.Inlines, true
+}
+
+// metaStrings extracts plain strings from a raw metadata value. It accepts
+// MetaString, MetaInlines, and MetaList values containing either of those.
+func metaStrings(raw interface{}) []string {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	switch m["t"] {
+	case "MetaString":
+		if s, ok := m["c"].(string); ok {
+			return []string{s}
+		}
+	case "MetaInlines":
+		ll, _ := m["c"].([]interface{})
+		buf := strings.Builder{}
+		for _, l := range ll {
+			l, _ := l.(map[string]interface{})
+			switch l["t"] {
+			case "Str":
+				s, _ := l["c"].(string)
+				buf.WriteString(s)
+			case "Space", "SoftBreak":
+				buf.WriteString(" ")
+			}
+		}
+		return []string{buf.String()}
+	case "MetaList":
+		ret := []string{}
+		ii, _ := m["c"].([]interface{})
+		for _, i := range ii {
+			ret = append(ret, metaStrings(i)...)
+		}
+		return ret
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package context
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/adnsv/go-pandoc"
+)
+
+// Document describes a markdown asset for links and cross-references between
+// the assets of a project. Pandoc generates heading identifiers per file, so
+// the generated identifiers are prefixed with a namespace to keep them unique.
+type Document struct {
+	Namespace    string          // Prefix for generated heading identifiers, empty to disable namespacing
+	FirstHeading string          // Identifier of the first heading, the target of links to the document
+	generated    map[string]bool // Heading identifiers generated by pandoc
+	explicit     map[string]bool // Heading identifiers written in the markdown source
+}
+
+// NewDocument collects the headings of a markdown asset. The explicit parameter
+// holds the heading identifiers written in the source (see explicitHeadingIDs),
+// these are kept as they are; the identifiers generated by pandoc are prefixed
+// with the namespace.
+func NewDocument(bb pandoc.BlockList, explicit map[string]bool, namespace string) *Document {
+	d := &Document{Namespace: namespace, generated: map[string]bool{}, explicit: map[string]bool{}}
+	for _, h := range headings(bb) {
+		id := h.Attr.Identifier
+		if id == "" {
+			continue
+		}
+		if d.FirstHeading == "" {
+			d.FirstHeading = id
+		}
+		if explicit[id] {
+			d.explicit[id] = true
+		} else {
+			d.generated[id] = true
+		}
+	}
+	return d
+}
+
+// markdownReader is the pandoc reader used for markdown assets and values.
+const markdownReader = "markdown"
+
+// explicitHeadingIDs returns the heading identifiers written in a markdown file.
+// The file is converted again with the same reader and its auto_identifiers
+// extension disabled, so that only the identifiers given in the source remain.
+func explicitHeadingIDs(fn string) (map[string]bool, error) {
+	jbuf, err := exec.Command("pandoc", "-f", markdownReader+"-auto_identifiers", "-t", "json", fn).Output()
+	if err != nil {
+		return nil, fmt.Errorf("pandoc error: %w", err)
+	}
+	d, err := loadDocument(jbuf)
+	if err != nil {
+		return nil, err
+	}
+	bb, err := d.Flow()
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, h := range headings(bb) {
+		if h.Attr.Identifier != "" {
+			ids[h.Attr.Identifier] = true
+		}
+	}
+	return ids, nil
+}
+
+// qualify returns the identifier used in the ConTeXt output for an identifier
+// within the document.
+func (d *Document) qualify(id string) string {
+	if d == nil || d.Namespace == "" || !d.generated[id] {
+		return id
+	}
+	return d.Namespace + ":" + id
+}
+
+// headings returns the headings of a document, including headings nested in
+// divs and block quotes.
+func headings(bb pandoc.BlockList) []*pandoc.Header {
+	ret := []*pandoc.Header{}
+	for _, b := range bb {
+		switch b := b.(type) {
+		case *pandoc.Header:
+			ret = append(ret, b)
+		case *pandoc.Div:
+			ret = append(ret, headings(b.Blocks)...)
+		case *pandoc.BlockQuote:
+			ret = append(ret, headings(b.Blocks)...)
+		}
+	}
+	return ret
+}
+
+// fileSlug converts a file name to a lowercase slug of letters, digits,
+// underscores, and hyphens. Runs of other characters become a single hyphen.
+func fileSlug(name string) string {
+	buf := strings.Builder{}
+	sep := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			if sep && buf.Len() > 0 {
+				buf.WriteByte('-')
+			}
+			buf.WriteRune(r)
+			sep = false
+		} else {
+			sep = true
+		}
+	}
+	if buf.Len() == 0 {
+		return "doc"
+	}
+	return buf.String()
+}
+
+// documentNamespace derives a namespace for a markdown asset from its file
+// name, adding a number when the name is already used by another asset.
+func documentNamespace(fn string, used map[string]bool) string {
+	base := filepath.Base(fn)
+	base = fileSlug(strings.TrimSuffix(base, filepath.Ext(base)))
+	ns := base
+	for i := 2; used[ns]; i++ {
+		ns = base + "-" + strconv.Itoa(i)
+	}
+	used[ns] = true
+	return ns
+}
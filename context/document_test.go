@@ -0,0 +1,67 @@
+package context
+
+import (
+	"testing"
+
+	"github.com/adnsv/go-pandoc"
+)
+
+func TestFileSlug(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"chapter2", "chapter2"},
+		{"01 Getting Started", "01-getting-started"},
+		{"snake_case and dots.v2", "snake_case-and-dots-v2"},
+		{"--Übersicht (C++)", "übersicht-c"},
+		{"", "doc"},
+	}
+	for _, tt := range tests {
+		if got := fileSlug(tt.name); got != tt.want {
+			t.Errorf("fileSlug(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentNamespace(t *testing.T) {
+	used := map[string]bool{}
+	for _, want := range []string{"chapter2", "chapter2-2", "01-intro"} {
+		fn := map[string]string{"chapter2": "/a/chapter2.md", "chapter2-2": "/b/chapter2.md", "01-intro": "/a/01 Intro.md"}[want]
+		if got := documentNamespace(fn, used); got != want {
+			t.Errorf("documentNamespace(%q) = %q, want %q", fn, got, want)
+		}
+	}
+}
+
+func TestResolveIdentifiers(t *testing.T) {
+	header := func(id string) *pandoc.Header {
+		return &pandoc.Header{Level: 1, Attr: pandoc.Attr{Identifier: id}}
+	}
+	ch1 := NewDocument(pandoc.BlockList{header("overview"), header("intro")}, map[string]bool{"intro": true}, "ch1")
+	ch2 := NewDocument(pandoc.BlockList{header("overview"), header("setup")}, nil, "ch2")
+	w := NewWriter(nil, "")
+	w.Documents = map[string]*Document{"/ch1.md": ch1, "/ch2.md": ch2}
+	w.Document = ch1
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"overview", "ch1:overview"}, // generated, within the document
+		{"intro", "intro"},           // explicit identifiers are kept
+		{"setup", "ch2:setup"},       // generated in another document
+		{"fig:x", "fig:x"},           // unknown identifiers are kept
+	}
+	for _, tt := range tests {
+		if got := w.ref(tt.id); got != tt.want {
+			t.Errorf("ref(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+	if len(w.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", w.Warnings)
+	}
+	if got := w.anchor("overview"); got != "ch1:overview" {
+		t.Errorf("anchor(overview) = %q", got)
+	}
+}
@@ -0,0 +1,261 @@
+package context
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Token classes produced by the syntax highlighter. The template maps them to
+// ConTeXt styles and colors in its highlight section.
+const (
+	tokComment  = "comment"
+	tokKeyword  = "keyword"
+	tokType     = "type"
+	tokBuiltin  = "builtin"
+	tokString   = "string"
+	tokNumber   = "number"
+	tokLiteral  = "literal"  // true, false, nil, null, and the like
+	tokKey      = "key"      // YAML and JSON mapping keys
+	tokVariable = "variable" // Shell variables, YAML anchors and aliases
+	tokWord     = "word"     // Pseudo class, the lexer classifies the matched text
+)
+
+// token is a piece of source code with its highlighting class. Plain text has an
+// empty class.
+type token struct {
+	class string
+	text  string
+}
+
+// lexRule matches a token at the current position. When the expression has a
+// capture group, only the group is given the class, the rest of the match is
+// plain text.
+type lexRule struct {
+	re    *regexp.Regexp
+	class string
+}
+
+// lexer is a simple rule-based tokenizer. The rules are tried in order at each
+// position, text that matches no rule is emitted as plain text.
+type lexer struct {
+	rules    []lexRule
+	classify func(word string) string // Class of the text matched by tokWord rules
+}
+
+// rule compiles a lexer rule anchored at the current position.
+func rule(expr, class string) lexRule {
+	return lexRule{regexp.MustCompile(`^(?:` + expr + `)`), class}
+}
+
+// wordClasses builds a word classifier from lists of words for each class.
+func wordClasses(classes map[string]string) func(string) string {
+	m := map[string]string{}
+	for class, words := range classes {
+		for _, w := range strings.Fields(words) {
+			m[w] = class
+		}
+	}
+	return func(s string) string { return m[s] }
+}
+
+var goLexer = &lexer{
+	rules: []lexRule{
+		rule(`//[^\n]*`, tokComment),
+		rule(`/\*[\s\S]*?\*/`, tokComment),
+		rule("`[^`]*`", tokString),
+		rule(`"(?:\\.|[^"\\\n])*"`, tokString),
+		rule(`'(?:\\.|[^'\\\n])*'`, tokString),
+		rule(`(?:0[xXbBoO][0-9a-fA-F_]+|\d[\d_]*(?:\.\d*)?(?:[eE][-+]?\d+)?|\.\d+(?:[eE][-+]?\d+)?)i?`, tokNumber),
+		rule(`[\pL_][\pL\pN_]*`, tokWord),
+	},
+	classify: wordClasses(map[string]string{
+		tokKeyword: `break case chan const continue default defer else fallthrough for func go goto
+			if import interface map package range return select struct switch type var`,
+		tokType: `any bool byte comparable complex64 complex128 error float32 float64 int int8 int16
+			int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr`,
+		tokBuiltin: `append cap clear close complex copy delete imag len make max min new panic print
+			println real recover`,
+		tokLiteral: `true false nil iota`,
+	}),
+}
+
+var jsonLexer = &lexer{
+	rules: []lexRule{
+		rule(`("(?:\\.|[^"\\\n])*")\s*:`, tokKey),
+		rule(`"(?:\\.|[^"\\\n])*"`, tokString),
+		rule(`-?\d+(?:\.\d+)?(?:[eE][-+]?\d+)?`, tokNumber),
+		rule(`[A-Za-z_]\w*`, tokWord),
+	},
+	classify: wordClasses(map[string]string{
+		tokLiteral: `true false null`,
+	}),
+}
+
+var reYAMLNumber = regexp.MustCompile(`^(?:[-+]?(?:\d[\d_]*(?:\.\d*)?(?:[eE][-+]?\d+)?|\.\d+)|0x[0-9a-fA-F]+|0o[0-7]+|[-+]?\.(?:inf|Inf|INF)|\.(?:nan|NaN|NAN))$`)
+
+var yamlLiterals = wordClasses(map[string]string{
+	tokLiteral: `true True TRUE false False FALSE yes Yes YES no No NO on On ON off Off OFF null Null NULL ~`,
+})
+
+var yamlLexer = &lexer{
+	rules: []lexRule{
+		rule(`#[^\n]*`, tokComment),
+		rule(`("(?:\\.|[^"\\\n])*"|'(?:[^'\n]|'')*'|[^\s#'"{}\[\],&*!|>%@:-][^\n:#]*?|-[^\s:#][^\n:#]*?)[ \t]*:(?:[ \t\n]|$)`, tokKey),
+		rule(`"(?:\\.|[^"\\])*"`, tokString),
+		rule(`'(?:[^']|'')*'`, tokString),
+		rule(`[&*][^\s,\[\]{}]+`, tokVariable),
+		rule(`![^\s,\[\]{}]*`, tokType),
+		rule(`[^\s:,\[\]{}#"'][^\s:,\[\]{}]*`, tokWord),
+	},
+	classify: func(s string) string {
+		if reYAMLNumber.MatchString(s) {
+			return tokNumber
+		}
+		return yamlLiterals(s)
+	},
+}
+
+var shellLexer = &lexer{
+	rules: []lexRule{
+		rule(`#[^\n]*`, tokComment),
+		rule(`'[^']*'`, tokString),
+		rule(`"(?:\\.|[^"\\])*"`, tokString),
+		rule(`\$\{[^}\n]*\}|\$[A-Za-z_]\w*|\$[0-9@#?$!*-]`, tokVariable),
+		rule(`\\.`, ""),
+		rule(`[^\s;|&<>()$"'\x60#\\][^\s;|&<>()$"'\x60\\]*`, tokWord),
+	},
+	classify: func(s string) string {
+		if reShellNumber.MatchString(s) {
+			return tokNumber
+		}
+		return shellWords(s)
+	},
+}
+
+var reShellNumber = regexp.MustCompile(`^\d+$`)
+
+var shellWords = wordClasses(map[string]string{
+	tokKeyword: `if then else elif fi for while until do done case esac in function select time !`,
+	tokBuiltin: `alias bg cd command declare echo eval exec exit export false fg getopts hash jobs
+		kill local printf pwd read readonly return set shift source test trap true type ulimit
+		umask unalias unset wait`,
+})
+
+// lexers maps code block languages (the first class of the block) to lexers.
+var lexers = map[string]*lexer{
+	"go":      goLexer,
+	"golang":  goLexer,
+	"json":    jsonLexer,
+	"yaml":    yamlLexer,
+	"yml":     yamlLexer,
+	"sh":      shellLexer,
+	"bash":    shellLexer,
+	"shell":   shellLexer,
+	"zsh":     shellLexer,
+	"console": shellLexer,
+}
+
+// tokenize splits source code into tokens. Adjacent plain text is merged into a
+// single token.
+func (lx *lexer) tokenize(src string) []token {
+	ret := []token{}
+	emit := func(class, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(ret); n > 0 && class == "" && ret[n-1].class == "" {
+			ret[n-1].text += text
+			return
+		}
+		ret = append(ret, token{class, text})
+	}
+
+	for src != "" {
+		matched := false
+		for _, r := range lx.rules {
+			m := r.re.FindStringSubmatchIndex(src)
+			if m == nil || m[1] == 0 {
+				continue
+			}
+			class := r.class
+			if len(m) > 2 && m[2] >= 0 {
+				emit("", src[:m[2]])
+				if class == tokWord {
+					class = lx.classify(src[m[2]:m[3]])
+				}
+				emit(class, src[m[2]:m[3]])
+				emit("", src[m[3]:m[1]])
+			} else {
+				if class == tokWord {
+					class = lx.classify(src[:m[1]])
+				}
+				emit(class, src[:m[1]])
+			}
+			src = src[m[1]:]
+			matched = true
+			break
+		}
+		if !matched {
+			_, n := utf8.DecodeRuneInString(src)
+			emit("", src[:n])
+			src = src[n:]
+		}
+	}
+	return ret
+}
+
+// expandTabs replaces tab characters with spaces, using tab stops every width
+// columns.
+func expandTabs(s string, width int) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	buf := strings.Builder{}
+	col := 0
+	for _, r := range s {
+		switch r {
+		case '\t':
+			n := width - col%width
+			buf.WriteString(strings.Repeat(" ", n))
+			col += n
+		case '\n':
+			buf.WriteRune(r)
+			col = 0
+		default:
+			buf.WriteRune(r)
+			col++
+		}
+	}
+	return buf.String()
+}
+
+// highlight renders source code as ConTeXt markup, with tokens styled according
+// to the theme. Token text is split at line breaks, so that each line is styled
+// separately. When there is no lexer for the language, it returns the escaped
+// source code and false.
+func highlight(src, lang string, theme map[string]SpanStyle) (string, bool) {
+	lx := lexers[strings.ToLower(lang)]
+	if lx == nil {
+		return letterEscaper.Replace(src), false
+	}
+	buf := strings.Builder{}
+	for _, t := range lx.tokenize(src) {
+		open, close := "", ""
+		if st, ok := theme[t.class]; ok && t.class != "" {
+			open, close = styleCommands(st)
+		}
+		for i, line := range strings.Split(t.text, "\n") {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			if line == "" {
+				continue
+			}
+			buf.WriteString(open)
+			buf.WriteString(letterEscaper.Replace(line))
+			buf.WriteString(close)
+		}
+	}
+	return buf.String(), true
+}
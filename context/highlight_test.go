@@ -0,0 +1,54 @@
+package context
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		lang string
+		src  string
+		want []token
+	}{
+		{"go", `x := "s" // c`, []token{
+			{"", "x := "}, {tokString, `"s"`}, {"", " "}, {tokComment, "// c"},
+		}},
+		{"go", "func f() int { return 0x1F }", []token{
+			{tokKeyword, "func"}, {"", " f() "}, {tokType, "int"}, {"", " { "},
+			{tokKeyword, "return"}, {"", " "}, {tokNumber, "0x1F"}, {"", " }"},
+		}},
+		{"json", `{"a": true}`, []token{
+			{"", "{"}, {tokKey, `"a"`}, {"", ": "}, {tokLiteral, "true"}, {"", "}"},
+		}},
+		{"yaml", "key: 12 # c", []token{
+			{tokKey, "key"}, {"", ": "}, {tokNumber, "12"}, {"", " "}, {tokComment, "# c"},
+		}},
+		{"sh", "echo $HOME ~/x", []token{
+			{tokBuiltin, "echo"}, {"", " "}, {tokVariable, "$HOME"}, {"", " ~/x"},
+		}},
+	}
+	for _, tt := range tests {
+		got := lexers[tt.lang].tokenize(tt.src)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%s, %q) =\n%v\nwant\n%v", tt.lang, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightEscaping(t *testing.T) {
+	for _, lang := range []string{"sh", "none"} {
+		got, _ := highlight(`cd ~/src && echo "50%" #{x}`, lang, nil)
+		for _, bad := range []string{`\~`, `\&`, `\#`} {
+			if strings.Contains(got, bad) {
+				t.Errorf("highlight(%s) contains %q: %s", lang, bad, got)
+			}
+		}
+		for _, s := range []string{`\lettertilde `, `\letterampersand `, `\letterpercent `, `\letterhash `, `\letterleftbrace `} {
+			if !strings.Contains(got, s) {
+				t.Errorf("highlight(%s) does not contain %q: %s", lang, s, got)
+			}
+		}
+	}
+}
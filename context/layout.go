@@ -0,0 +1,255 @@
+package context
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Layout describes the page layout for a page size. A layout is declared in the
+// template either as an opaque ConTeXt \setuplayout argument string (legacy form),
+// or as a structured set of settings that is validated and rendered by panctx.
+type Layout struct {
+	Raw string `yaml:"-"` // Opaque \setuplayout arguments (legacy string form)
+
+	Backspace   string `yaml:"backspace"`   // Space between the spine and the text area
+	Topspace    string `yaml:"topspace"`    // Space between the top edge and the header
+	Width       string `yaml:"width"`       // Text area width
+	Height      string `yaml:"height"`      // Text area height (including header and footer)
+	Header      string `yaml:"header"`      // Header height
+	Footer      string `yaml:"footer"`      // Footer height
+	Margin      string `yaml:"margin"`      // Margin width
+	Orientation string `yaml:"orientation"` // portrait (default) or landscape
+	Columns     int    `yaml:"columns"`     // Number of text columns
+	Options     string `yaml:"options"`     // Additional raw \setuplayout arguments
+
+	Variants map[string]*Layout `yaml:"variants"` // Named layouts (e.g. front, body, landscape)
+}
+
+// UnmarshalYAML accepts both the legacy string form and the structured form.
+func (l *Layout) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		l.Raw = n.Value
+		return nil
+	}
+	type plain Layout
+	return n.Decode((*plain)(l))
+}
+
+// knownPaperSizes maps the lowercased names of the paper sizes predefined by
+// ConTeXt to their spelling. ConTeXt paper names are case-sensitive, so a
+// matching name is written with the spelling listed here.
+var knownPaperSizes = func() map[string]string {
+	m := map[string]string{}
+	for _, s := range []string{"A", "B", "C"} {
+		for i := 0; i <= 10; i++ {
+			m[strings.ToLower(s+strconv.Itoa(i))] = s + strconv.Itoa(i)
+		}
+	}
+	for _, s := range []string{
+		"letter", "legal", "executive", "tabloid", "ledger", "folio",
+		"quarto", "statement", "screen", "S3", "S4", "S5", "S6",
+		"envelope9", "envelope10", "envelope11", "envelope12", "envelope14",
+	} {
+		m[strings.ToLower(s)] = s
+	}
+	return m
+}()
+
+// paperName returns the ConTeXt spelling of a predefined paper size, or an
+// empty string if the name is not predefined.
+func paperName(s string) string {
+	return knownPaperSizes[strings.ToLower(s)]
+}
+
+var reDimension = regexp.MustCompile(`^[-+]?(\d+(\.\d*)?|\.\d+)\s*(pt|bp|mm|cm|in|pc|dd|cc|sp|em|ex)$`)
+
+// validateDimension checks that s is a ConTeXt dimension. Keywords listed in
+// allowed are accepted as well.
+func validateDimension(name, s string, allowed ...string) error {
+	if s == "" || reDimension.MatchString(s) {
+		return nil
+	}
+	for _, a := range allowed {
+		if s == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s '%s': expected a dimension (e.g. 72pt, 2.5cm)", name, s)
+}
+
+// validate checks the structured layout settings, including all variants.
+func (l *Layout) validate() error {
+	if l.Raw != "" {
+		return nil
+	}
+	dims := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"backspace", l.Backspace, nil},
+		{"topspace", l.Topspace, nil},
+		{"width", l.Width, []string{"middle", "fit"}},
+		{"height", l.Height, []string{"middle", "fit"}},
+		{"header", l.Header, nil},
+		{"footer", l.Footer, nil},
+		{"margin", l.Margin, nil},
+	}
+	for _, d := range dims {
+		if err := validateDimension(d.name, d.value, d.allowed...); err != nil {
+			return err
+		}
+	}
+	switch l.Orientation {
+	case "", "portrait", "landscape":
+	default:
+		return fmt.Errorf("invalid orientation '%s': expected portrait or landscape", l.Orientation)
+	}
+	if l.Columns < 0 {
+		return fmt.Errorf("invalid number of columns: %d", l.Columns)
+	}
+	for k, v := range l.Variants {
+		if v.Raw == "" && len(v.Variants) > 0 {
+			return fmt.Errorf("layout variant '%s' cannot declare nested variants", k)
+		}
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("layout variant '%s': %w", k, err)
+		}
+	}
+	return nil
+}
+
+// settings returns the \setuplayout key=value arguments for the layout.
+func (l *Layout) settings() []string {
+	if l.Raw != "" {
+		return []string{l.Raw}
+	}
+	ret := []string{}
+	add := func(k, v string) {
+		if v != "" {
+			ret = append(ret, k+"="+v)
+		}
+	}
+	add("backspace", l.Backspace)
+	add("topspace", l.Topspace)
+	add("width", l.Width)
+	add("height", l.Height)
+	add("header", l.Header)
+	add("footer", l.Footer)
+	add("margin", l.Margin)
+	if l.Columns > 0 {
+		add("columns", strconv.Itoa(l.Columns))
+	}
+	if l.Options != "" {
+		ret = append(ret, l.Options)
+	}
+	return ret
+}
+
+// paperSpec formats a \setuppapersize argument with an optional orientation.
+func paperSpec(size, orientation string) string {
+	if orientation == "landscape" {
+		return size + ",landscape"
+	}
+	return size
+}
+
+// ResolveLayout validates the page size and selects the layout that matches it.
+// It fills in the "layout" and "papersize" definitions. The page size must either
+// be known to ConTeXt or have a layout declared in the template. When the
+// template declares layouts, the page size must have a matching entry. Names of
+// predefined paper sizes are matched case-insensitively and rewritten with the
+// spelling ConTeXt expects.
+func (prj *Project) ResolveLayout() error {
+	pagesize := prj.Definitions["pagesize"]
+	if pagesize == "" {
+		return fmt.Errorf("missing pagesize definition")
+	}
+
+	l, ok := prj.Layouts[pagesize]
+	if !ok {
+		if paperName(pagesize) == "" {
+			return fmt.Errorf("unknown pagesize '%s'", pagesize)
+		}
+		pagesize = paperName(pagesize)
+		prj.Definitions["pagesize"] = pagesize
+		l, ok = prj.Layouts[pagesize]
+	}
+	if !ok && len(prj.Layouts) > 0 {
+		names := []string{}
+		for k := range prj.Layouts {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("no layout for pagesize '%s' (available: %s)", pagesize, strings.Join(names, ", "))
+	}
+
+	if papersize, ok := prj.Definitions["papersize"]; !ok {
+		prj.Definitions["papersize"] = pagesize
+	} else if name := paperName(papersize); name != "" {
+		prj.Definitions["papersize"] = name
+	}
+
+	if l == nil {
+		return nil
+	}
+	if err := l.validate(); err != nil {
+		return fmt.Errorf("layout for %s: %w", pagesize, err)
+	}
+	prj.layout = l
+	prj.Definitions["layout"] = strings.Join(l.settings(), ",")
+	return nil
+}
+
+// renderLayout produces ConTeXt markup for the $<layout:name>$ placeholder.
+// An empty name yields the complete setup: paper size, main layout, and
+// definitions of all named variants. A variant name yields the commands that
+// switch to that variant, and "default" switches back to the main layout.
+func (prj *Project) renderLayout(name string) (string, error) {
+	pagesize := prj.Definitions["pagesize"]
+	papersize := prj.Definitions["papersize"]
+	l := prj.layout
+	if l == nil {
+		l = &Layout{}
+	}
+
+	setupPaper := func(orientation string) string {
+		return "\\setuppapersize[" + paperSpec(pagesize, orientation) + "][" + paperSpec(papersize, orientation) + "]"
+	}
+
+	switch name {
+	case "":
+		lines := []string{setupPaper(l.Orientation)}
+		if s := l.settings(); len(s) > 0 {
+			lines = append(lines, "\\setuplayout["+strings.Join(s, ",")+"]")
+		}
+		names := []string{}
+		for k := range l.Variants {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			lines = append(lines, "\\definelayout["+k+"]["+strings.Join(l.Variants[k].settings(), ",")+"]")
+		}
+		return strings.Join(lines, "\n"), nil
+
+	case "default":
+		return setupPaper(l.Orientation) + "\n\\setuplayout[reset]", nil
+
+	default:
+		v, ok := l.Variants[name]
+		if !ok {
+			return "", fmt.Errorf("unknown layout variant: %s", name)
+		}
+		orientation := v.Orientation
+		if orientation == "" {
+			orientation = l.Orientation
+		}
+		return setupPaper(orientation) + "\n\\setuplayout[" + name + "]", nil
+	}
+}
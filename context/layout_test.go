@@ -0,0 +1,73 @@
+package context
+
+import "testing"
+
+func TestResolveLayoutPaperNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		defs      map[string]string
+		layouts   map[string]*Layout
+		pagesize  string
+		papersize string
+		layout    string
+	}{
+		{
+			name:      "canonical",
+			defs:      map[string]string{"pagesize": "A4"},
+			pagesize:  "A4",
+			papersize: "A4",
+		},
+		{
+			name:      "lowercase",
+			defs:      map[string]string{"pagesize": "a5", "papersize": "a4"},
+			pagesize:  "A5",
+			papersize: "A4",
+		},
+		{
+			name:      "uppercase",
+			defs:      map[string]string{"pagesize": "LETTER"},
+			pagesize:  "letter",
+			papersize: "letter",
+		},
+		{
+			name:      "layout",
+			defs:      map[string]string{"pagesize": "a4"},
+			layouts:   map[string]*Layout{"A4": {Width: "middle"}},
+			pagesize:  "A4",
+			papersize: "A4",
+			layout:    "width=middle",
+		},
+		{
+			name:      "custom",
+			defs:      map[string]string{"pagesize": "book", "papersize": "a4"},
+			layouts:   map[string]*Layout{"book": {Raw: "width=10cm"}},
+			pagesize:  "book",
+			papersize: "A4",
+			layout:    "width=10cm",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prj := &Project{Definitions: tt.defs, Layouts: tt.layouts}
+			if err := prj.ResolveLayout(); err != nil {
+				t.Fatal(err)
+			}
+			if got := prj.Definitions["pagesize"]; got != tt.pagesize {
+				t.Errorf("pagesize = %q, want %q", got, tt.pagesize)
+			}
+			if got := prj.Definitions["papersize"]; got != tt.papersize {
+				t.Errorf("papersize = %q, want %q", got, tt.papersize)
+			}
+			if got := prj.Definitions["layout"]; got != tt.layout {
+				t.Errorf("layout = %q, want %q", got, tt.layout)
+			}
+		})
+	}
+}
+
+func TestResolveLayoutUnknownPaper(t *testing.T) {
+	prj := &Project{Definitions: map[string]string{"pagesize": "a11"}}
+	if err := prj.ResolveLayout(); err == nil {
+		t.Fatal("expected an error for an unknown pagesize")
+	}
+}
@@ -0,0 +1,398 @@
+package context
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// mathCommands maps LaTeX math commands to their ConTeXt equivalents.
+var mathCommands = map[string]string{
+	"text":         "mathtext",
+	"textrm":       "mathtext",
+	"textnormal":   "mathtext",
+	"mbox":         "mathtext",
+	"mathbb":       "blackboard",
+	"mathcal":      "mathscript",
+	"mathscr":      "mathscript",
+	"mathfrak":     "fraktur",
+	"operatorname": "mfunction",
+}
+
+// mathTextStyles maps LaTeX text style commands to ConTeXt style switches
+// applied within \mathtext.
+var mathTextStyles = map[string]string{
+	"textbf": "\\bf ",
+	"textit": "\\it ",
+	"textsf": "\\ss ",
+	"texttt": "\\tt ",
+}
+
+// mathMatrices maps LaTeX matrix environments to the fences of a ConTeXt
+// \startmathmatrix.
+var mathMatrices = map[string][2]string{
+	"matrix":      {"", ""},
+	"smallmatrix": {"", ""},
+	"array":       {"", ""},
+	"pmatrix":     {"(", ")"},
+	"bmatrix":     {"[", "]"},
+	"Bmatrix":     {"\\{", "\\}"},
+	"vmatrix":     {"|", "|"},
+	"Vmatrix":     {"\\|", "\\|"},
+}
+
+// reLatexEnvironment matches a LaTeX environment that makes up the whole text of
+// a raw block or inline.
+var reLatexEnvironment = regexp.MustCompile(`^\s*\\begin\{([A-Za-z]+)\*?\}[\s\S]*\\end\{[A-Za-z]+\*?\}\s*$`)
+
+// mathEnvironments lists the LaTeX math environments that are translated when
+// they make up a raw block or inline.
+var mathEnvironments = map[string]bool{
+	"equation":    true,
+	"displaymath": true,
+	"align":       true,
+	"alignat":     true,
+	"eqnarray":    true,
+	"flalign":     true,
+	"gather":      true,
+	"multline":    true,
+}
+
+// latexEnvironment returns the name (without a star) of the LaTeX environment
+// that makes up raw TeX, or an empty string.
+func latexEnvironment(s string) string {
+	m := reLatexEnvironment.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// isMathEnvironment reports whether raw TeX is a LaTeX display math environment.
+func isMathEnvironment(s string) bool {
+	return mathEnvironments[latexEnvironment(s)]
+}
+
+// reTrailingRowBreak matches a \\ line break (with optional spacing) at the end
+// of math.
+var reTrailingRowBreak = regexp.MustCompile(`\\\\\s*(?:\[[^\]]*\])?\s*$`)
+
+// mathTranslation holds the result of translating LaTeX math to ConTeXt.
+type mathTranslation struct {
+	text     string   // ConTeXt math
+	label    string   // Identifier from \label
+	tag      string   // Custom equation number from \tag
+	problems []string // Constructs that could not be translated
+}
+
+// translateMath converts LaTeX math idioms to ConTeXt math: text and font
+// commands, \operatorname, alignment, cases and matrix environments, and \\ line
+// breaks in display math. The \label and \tag commands are removed and returned
+// separately, so that they can be placed with \placeformula.
+func translateMath(s string, display bool) mathTranslation {
+	t := mathTranslation{}
+	s = t.translate(s, display)
+	if display && hasRowBreaks(s) {
+		if strings.Contains(s, "&") {
+			s = mathAlignment(s, "align")
+		} else {
+			s = mathAlignment(s, "gather")
+		}
+	} else if display {
+		// a single row ending with \\ would give ConTeXt an empty row
+		s = reTrailingRowBreak.ReplaceAllString(s, "")
+	}
+	t.text = strings.TrimSpace(s)
+	return t
+}
+
+// translate converts commands and environments within s.
+func (t *mathTranslation) translate(s string, display bool) string {
+	buf := strings.Builder{}
+	for i := 0; i < len(s); {
+		if s[i] != '\\' {
+			buf.WriteByte(s[i])
+			i++
+			continue
+		}
+		name, n := mathCommandName(s[i+1:])
+		if name == "" {
+			// escaped character or \\ line break
+			end := i + 2
+			if end > len(s) {
+				end = len(s)
+			}
+			buf.WriteString(s[i:end])
+			i = end
+			continue
+		}
+		j := i + 1 + n
+		switch {
+		case name == "begin":
+			env, body, end, ok := mathEnvironment(s, i)
+			if !ok {
+				t.problems = append(t.problems, "unbalanced \\begin")
+				buf.WriteString(s[i:])
+				return buf.String()
+			}
+			if !display {
+				t.problems = append(t.problems, "environment "+env+" in inline math")
+			}
+			buf.WriteString(t.environment(env, body, display))
+			i = end
+
+		case name == "label" || name == "tag" || name == "tag*":
+			arg, end, ok := mathArg(s, j)
+			if !ok {
+				buf.WriteString(s[i:j])
+				i = j
+				continue
+			}
+			if name == "label" {
+				t.label = arg
+			} else if display {
+				t.tag = arg
+			} else {
+				t.problems = append(t.problems, "\\tag in inline math")
+			}
+			i = end
+
+		case name == "nonumber" || name == "notag":
+			i = j
+
+		case mathCommands[name] != "":
+			buf.WriteString("\\" + mathCommands[name])
+			i = j
+
+		case mathTextStyles[name] != "":
+			arg, end, ok := mathArg(s, j)
+			if !ok {
+				buf.WriteString(s[i:j])
+				i = j
+				continue
+			}
+			buf.WriteString("\\mathtext{" + mathTextStyles[name] + arg + "}")
+			i = end
+
+		case name == "hspace":
+			arg, end, ok := mathArg(s, j)
+			if !ok {
+				buf.WriteString(s[i:j])
+				i = j
+				continue
+			}
+			buf.WriteString("\\hskip " + arg + " ")
+			i = end
+
+		default:
+			buf.WriteString(s[i:j])
+			i = j
+		}
+	}
+	return buf.String()
+}
+
+// environment converts the body of a LaTeX environment.
+func (t *mathTranslation) environment(env, body string, display bool) string {
+	base := strings.TrimSuffix(env, "*")
+	switch base {
+	case "equation", "displaymath":
+		return t.translate(body, display)
+	case "alignat", "alignedat":
+		// skip the number of columns
+		if _, end, ok := mathArg(body, 0); ok {
+			body = body[end:]
+		}
+		return mathAlignment(t.translate(body, display), "align")
+	case "align", "aligned", "eqnarray", "flalign", "split":
+		return mathAlignment(t.translate(body, display), "align")
+	case "gather", "gathered", "multline":
+		return mathAlignment(t.translate(body, display), "gather")
+	case "cases", "dcases":
+		return mathAlignment(t.translate(body, display), "cases")
+	}
+	if fences, ok := mathMatrices[base]; ok {
+		if base == "array" {
+			if _, end, ok := mathArg(body, 0); ok {
+				body = body[end:]
+			}
+		}
+		rows := mathAlignment(t.translate(body, display), "matrix")
+		if fences[0] == "" {
+			return rows
+		}
+		return strings.Replace(rows, "\\startmathmatrix",
+			"\\startmathmatrix[left={\\left"+fences[0]+"},right={\\right"+fences[1]+"}]", 1)
+	}
+	t.problems = append(t.problems, "unsupported environment "+env)
+	return "\\begin{" + env + "}" + body + "\\end{" + env + "}"
+}
+
+// mathAlignment converts rows separated by \\ and cells separated by & to a ConTeXt
+// math alignment, cases, or matrix.
+func mathAlignment(s string, kind string) string {
+	rows := splitMathRows(s)
+	cols := 1
+	for _, r := range rows {
+		if len(r) > cols {
+			cols = len(r)
+		}
+	}
+
+	buf := strings.Builder{}
+	switch kind {
+	case "gather":
+		buf.WriteString("\\startmathalignment[n=1,align={middle}]")
+	case "cases":
+		buf.WriteString("\\startmathcases")
+	case "matrix":
+		buf.WriteString("\\startmathmatrix")
+	default:
+		if cols != 2 {
+			buf.WriteString(fmt.Sprintf("\\startmathalignment[n=%d]", cols))
+		} else {
+			buf.WriteString("\\startmathalignment")
+		}
+	}
+	for _, r := range rows {
+		buf.WriteString("\n")
+		for _, c := range r {
+			buf.WriteString("\\NC " + strings.TrimSpace(c) + " ")
+		}
+		buf.WriteString("\\NR")
+	}
+	switch kind {
+	case "cases":
+		buf.WriteString("\n\\stopmathcases")
+	case "matrix":
+		buf.WriteString("\n\\stopmathmatrix")
+	default:
+		buf.WriteString("\n\\stopmathalignment")
+	}
+	return buf.String()
+}
+
+// hasRowBreaks reports whether s contains \\ line breaks outside of braces.
+func hasRowBreaks(s string) bool {
+	rows := splitMathRows(s)
+	return len(rows) > 1
+}
+
+// splitMathRows splits math into rows at \\ and into cells at &, ignoring
+// breaks within braces. Empty trailing rows and optional spacing after \\
+// are dropped.
+func splitMathRows(s string) [][]string {
+	rows := [][]string{}
+	cells := []string{}
+	cell := strings.Builder{}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\\' && depth == 0:
+			cells = append(cells, cell.String())
+			cell.Reset()
+			rows = append(rows, cells)
+			cells = []string{}
+			i++
+			if rest := strings.TrimLeft(s[i+1:], " \t"); strings.HasPrefix(rest, "[") {
+				if end := strings.IndexByte(rest, ']'); end >= 0 {
+					i = len(s) - len(rest) + end
+				}
+			}
+		case c == '\\' && i+1 < len(s):
+			cell.WriteByte(c)
+			cell.WriteByte(s[i+1])
+			i++
+		case c == '&' && depth == 0:
+			cells = append(cells, cell.String())
+			cell.Reset()
+		default:
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+			}
+			cell.WriteByte(c)
+		}
+	}
+	if strings.TrimSpace(cell.String()) != "" || len(cells) > 0 {
+		rows = append(rows, append(cells, cell.String()))
+	}
+	return rows
+}
+
+// mathCommandName returns the name of the command at the beginning of s (after
+// the backslash) and its length. It returns an empty name for control symbols.
+func mathCommandName(s string) (string, int) {
+	n := 0
+	for n < len(s) && (s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z') {
+		n++
+	}
+	if n == 0 {
+		return "", 0
+	}
+	name := s[:n]
+	if n < len(s) && s[n] == '*' {
+		switch name {
+		case "tag":
+			return "tag*", n + 1
+		case "operatorname":
+			return name, n + 1
+		}
+	}
+	return name, n
+}
+
+// mathArg reads a brace-delimited argument starting at position i (after
+// optional spaces). It returns the argument and the position after it.
+func mathArg(s string, i int) (arg string, end int, ok bool) {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+		i++
+	}
+	if i >= len(s) || s[i] != '{' {
+		return "", i, false
+	}
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return s[i+1 : j], j + 1, true
+			}
+		}
+	}
+	return "", i, false
+}
+
+// mathEnvironment reads the environment that begins at position i with \begin.
+// It returns the name, the body, and the position after the matching \end.
+func mathEnvironment(s string, i int) (env, body string, end int, ok bool) {
+	env, start, ok := mathArg(s, i+len("\\begin"))
+	if !ok {
+		return "", "", i, false
+	}
+	open, close := "\\begin{"+env+"}", "\\end{"+env+"}"
+	depth := 1
+	for j := start; j < len(s); {
+		switch {
+		case strings.HasPrefix(s[j:], open):
+			depth++
+			j += len(open)
+		case strings.HasPrefix(s[j:], close):
+			depth--
+			if depth == 0 {
+				return env, s[start:j], j + len(close), true
+			}
+			j += len(close)
+		default:
+			j++
+		}
+	}
+	return "", "", i, false
+}
@@ -0,0 +1,129 @@
+package context
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslateMath(t *testing.T) {
+	tests := []struct {
+		name     string
+		tex      string
+		display  bool
+		want     string
+		label    string
+		tag      string
+		problems []string
+	}{
+		{
+			name: "text commands",
+			tex:  `\text{if } x \in \mathbb{R}, \operatorname{sgn} x`,
+			want: `\mathtext{if } x \in \blackboard{R}, \mfunction{sgn} x`,
+		},
+		{
+			name:    "trailing row break",
+			tex:     `a = b \\`,
+			display: true,
+			want:    `a = b`,
+		},
+		{
+			name:    "trailing row break with spacing",
+			tex:     `a = b \\[2pt] `,
+			display: true,
+			want:    `a = b`,
+		},
+		{
+			name:    "aligned",
+			tex:     `\begin{aligned} a &= b \\ c &= d \end{aligned}`,
+			display: true,
+			want:    "\\startmathalignment\n\\NC a \\NC = b \\NR\n\\NC c \\NC = d \\NR\n\\stopmathalignment",
+		},
+		{
+			name:    "align with trailing row break",
+			tex:     `\begin{align} a &= b \\ \end{align}`,
+			display: true,
+			want:    "\\startmathalignment\n\\NC a \\NC = b \\NR\n\\stopmathalignment",
+		},
+		{
+			name:    "top-level rows",
+			tex:     `a = b \\ c = d`,
+			display: true,
+			want:    "\\startmathalignment[n=1,align={middle}]\n\\NC a = b \\NR\n\\NC c = d \\NR\n\\stopmathalignment",
+		},
+		{
+			name:    "cases",
+			tex:     `f(x) = \begin{cases} 1 & x > 0 \\ 0 & \text{otherwise} \end{cases}`,
+			display: true,
+			want:    "f(x) = \\startmathcases\n\\NC 1 \\NC x > 0 \\NR\n\\NC 0 \\NC \\mathtext{otherwise} \\NR\n\\stopmathcases",
+		},
+		{
+			name:    "pmatrix",
+			tex:     `\begin{pmatrix} a & b \\ c & d \end{pmatrix}`,
+			display: true,
+			want:    "\\startmathmatrix[left={\\left(},right={\\right)}]\n\\NC a \\NC b \\NR\n\\NC c \\NC d \\NR\n\\stopmathmatrix",
+		},
+		{
+			name:    "label and tag",
+			tex:     `E = mc^2 \label{eq:e} \tag{*}`,
+			display: true,
+			want:    `E = mc^2`,
+			label:   "eq:e",
+			tag:     "*",
+		},
+		{
+			name:     "unknown environment",
+			tex:      `\begin{foo} x \end{foo}`,
+			display:  true,
+			want:     `\begin{foo} x \end{foo}`,
+			problems: []string{"unsupported environment foo"},
+		},
+		{
+			name:     "unbalanced environment",
+			tex:      `x \begin{aligned} a`,
+			display:  true,
+			want:     `x \begin{aligned} a`,
+			problems: []string{`unbalanced \begin`},
+		},
+		{
+			name:     "tag in inline math",
+			tex:      `x \tag{1}`,
+			want:     `x`,
+			problems: []string{`\tag in inline math`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := translateMath(tt.tex, tt.display)
+			if m.text != tt.want {
+				t.Errorf("text = %q, want %q", m.text, tt.want)
+			}
+			if m.label != tt.label || m.tag != tt.tag {
+				t.Errorf("label, tag = %q, %q, want %q, %q", m.label, m.tag, tt.label, tt.tag)
+			}
+			if !reflect.DeepEqual(m.problems, tt.problems) {
+				t.Errorf("problems = %q, want %q", m.problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestLatexEnvironment(t *testing.T) {
+	tests := []struct {
+		tex  string
+		env  string
+		math bool
+	}{
+		{"\\begin{align*}\na &= b\n\\end{align*}\n", "align", true},
+		{`\begin{equation} x \end{equation}`, "equation", true},
+		{`\begin{tikzpicture} \end{tikzpicture}`, "tikzpicture", false},
+		{`\startformula x \stopformula`, "", false},
+	}
+	for _, tt := range tests {
+		if env := latexEnvironment(tt.tex); env != tt.env {
+			t.Errorf("latexEnvironment(%q) = %q, want %q", tt.tex, env, tt.env)
+		}
+		if math := isMathEnvironment(tt.tex); math != tt.math {
+			t.Errorf("isMathEnvironment(%q) = %v, want %v", tt.tex, math, tt.math)
+		}
+	}
+}
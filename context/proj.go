@@ -10,6 +10,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/adnsv/go-pandoc"
@@ -25,22 +27,43 @@ type Project struct {
 	ConfigDir string // Directory containing the template configuration
 	WorkDir   string // Working directory for intermediate files
 
-	Definitions    map[string]string // Variable definitions for template substitution
-	Layouts        map[string]string // Page layout configurations mapped by page size
-	MarkdownAssets []*MarkdownAsset  // Markdown files to be converted
-	TemplateAssets []*TemplateAsset  // Template assets to be processed
+	Definitions    map[string]string    // Variable definitions for template substitution
+	Layouts        map[string]*Layout   // Page layout configurations mapped by page size
+	MarkdownAssets []*MarkdownAsset     // Markdown files to be converted
+	TemplateAssets []*TemplateAsset     // Template assets to be processed
+	Bibliography   []string             // Bibliography files (BibTeX or CSL-JSON)
+	SpanStyles     map[string]SpanStyle // Span class to ConTeXt style mapping
+	Highlight      map[string]SpanStyle // Syntax highlighting theme, by token class
+	ListOptions    ListOptions          // Itemize options by list type and nesting level
+	Headings       []Heading            // ConTeXt headings for markdown heading levels
+	ResourcePath   []string             // Directories searched for images, in order
+	Warnings       []Warning            // Problems found while processing markdown assets
+	Strict         bool                 // Fail processing when there are warnings
+
+	layout    *Layout              // Layout selected for the current page size
+	meta      map[string]metaValue // Inline values of the markdown front matter, by name
+	mdvars    map[string][]byte    // Cache of rendered $<mdvar:name>$ values
+	mainBuf   []byte               // Buffer containing the main input file content
+	mainDstFN string               // Destination path for the processed main file
+}
 
-	mainBuf   []byte // Buffer containing the main input file content
-	mainDstFN string // Destination path for the processed main file
+// metaValue is a definition loaded from the front matter of a markdown asset.
+// The inlines keep the formatting that is lost in the plain text definition.
+type metaValue struct {
+	text    string            // Plain text stored in Definitions
+	inlines pandoc.InlineList // Inline markdown of the value
+	srcFN   string            // Markdown asset that declares the value
 }
 
 // MarkdownAsset represents a Markdown file asset that will be converted to ConTeXt.
 // It tracks the source file, destination file, Pandoc JSON buffer, and parsed document.
 type MarkdownAsset struct {
-	srcFN string            // Source Markdown file path
-	dstFN string            // Destination ConTeXt file path
-	jbuf  []byte            // Pandoc JSON output buffer
-	d     *pandoc.Document  // Parsed Pandoc document
+	srcFN string           // Source Markdown file path
+	dstFN string           // Destination ConTeXt file path
+	jbuf  []byte           // Pandoc JSON output buffer
+	d     *pandoc.Document // Parsed Pandoc document
+
+	explicit map[string]bool // Heading identifiers written in the source
 }
 
 // TemplateAsset represents a template file asset that will be processed and copied
@@ -51,12 +74,14 @@ type TemplateAsset struct {
 }
 
 // NewProject creates a new Project instance with the specified working directory.
-// It initializes empty maps for Definitions and Layouts.
+// It initializes empty maps for Definitions, Layouts, SpanStyles, and Highlight.
 func NewProject(workdir string) *Project {
 	return &Project{
 		WorkDir:     workdir,
 		Definitions: map[string]string{},
-		Layouts:     map[string]string{},
+		Layouts:     map[string]*Layout{},
+		SpanStyles:  map[string]SpanStyle{},
+		Highlight:   map[string]SpanStyle{},
 	}
 }
 
@@ -73,9 +98,15 @@ func (prj *Project) LoadConfig(fn string) (err error) {
 	prj.ConfigDir = filepath.Dir(fn)
 
 	type templateLoader struct {
-		Definitions map[string]string `yaml:"def"`
-		Layouts     map[string]string `yaml:"layouts"`
-		Assets      []string          `yaml:"assets"`
+		Definitions  map[string]string    `yaml:"def"`
+		Layouts      map[string]*Layout   `yaml:"layouts"`
+		Assets       []string             `yaml:"assets"`
+		Bibliography []string             `yaml:"bibliography"`
+		Spans        map[string]SpanStyle `yaml:"spans"`
+		Highlight    map[string]SpanStyle `yaml:"highlight"`
+		Lists        *ListOptions         `yaml:"lists"`
+		Headings     []Heading            `yaml:"headings"`
+		ResourcePath []string             `yaml:"resource-path"`
 	}
 
 	t := templateLoader{}
@@ -92,6 +123,30 @@ func (prj *Project) LoadConfig(fn string) (err error) {
 		prj.Layouts[k] = v
 	}
 
+	for k, v := range t.Spans {
+		prj.SpanStyles[k] = v
+	}
+
+	for k, v := range t.Highlight {
+		prj.Highlight[k] = v
+	}
+
+	if t.Lists != nil {
+		prj.ListOptions = *t.Lists
+	}
+
+	if len(t.Headings) > 0 {
+		prj.Headings = t.Headings
+	}
+
+	for _, v := range t.ResourcePath {
+		dir, err := normalizePath(prj.ConfigDir, v)
+		if err != nil {
+			return err
+		}
+		prj.ResourcePath = append(prj.ResourcePath, dir)
+	}
+
 	for _, v := range t.Assets {
 		log.Printf("- loading asset %s\n", v)
 		a := &TemplateAsset{}
@@ -110,9 +165,40 @@ func (prj *Project) LoadConfig(fn string) (err error) {
 		a.dstFN = filepath.ToSlash(filepath.Join(prj.WorkDir, filepath.Base(a.srcFN)))
 		prj.TemplateAssets = append(prj.TemplateAssets, a)
 	}
+
+	for _, v := range t.Bibliography {
+		err = prj.addBibliography(prj.ConfigDir, v)
+		if err != nil {
+			return err
+		}
+	}
 	return
 }
 
+// addBibliography registers a bibliography file, resolving relative paths
+// against refdir. Duplicate registrations are ignored.
+func (prj *Project) addBibliography(refdir string, fn string) error {
+	log.Printf("- loading bibliography %s\n", fn)
+	fn, err := normalizePath(refdir, fn)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("path '%s' points to a directory instead of a file", fn)
+	}
+	for _, b := range prj.Bibliography {
+		if b == fn {
+			return nil
+		}
+	}
+	prj.Bibliography = append(prj.Bibliography, fn)
+	return nil
+}
+
 var re = regexp.MustCompile(`(?m)\$<((?:[^>\$])*)>\$`)
 
 // LoadMain loads the main input file and scans it for Markdown asset references.
@@ -151,16 +237,24 @@ func (prj *Project) LoadMain(fn string) (err error) {
 			md := &MarkdownAsset{srcFN: fn}
 			md.dstFN = filepath.ToSlash(filepath.Join(prj.WorkDir, filepath.Base(fn)+".tex"))
 
-			md.jbuf, err = exec.Command("pandoc", "-t", "json", fn).Output()
+			md.jbuf, err = exec.Command("pandoc", "-f", markdownReader, "-t", "json", fn).Output()
 			if err != nil {
 				return fmt.Errorf("pandoc error: %w", err)
 			}
-			md.d, err = pandoc.NewDocument(md.jbuf)
+			md.d, err = loadDocument(md.jbuf)
 			if err != nil {
 				return err
 			}
-			for k, v := range md.d.ParseMeta() {
-				prj.Definitions[k] = v
+			md.explicit, err = explicitHeadingIDs(fn)
+			if err != nil {
+				return err
+			}
+			prj.addMeta(md.d, fn)
+			for _, b := range metaStrings(md.d.Meta["bibliography"]) {
+				err = prj.addBibliography(filepath.Dir(fn), b)
+				if err != nil {
+					return err
+				}
 			}
 
 			prj.MarkdownAssets = append(prj.MarkdownAssets, md)
@@ -170,9 +264,154 @@ func (prj *Project) LoadMain(fn string) (err error) {
 	return
 }
 
+// addMeta adds the front matter values of a markdown asset to the definitions.
+// The inlines of each value are kept for $<mdvar:name>$.
+func (prj *Project) addMeta(d *pandoc.Document, fn string) {
+	for k, v := range d.ParseMeta() {
+		prj.Definitions[k] = v
+		if ll, ok := metaInlines(d.Meta[k]); ok {
+			if prj.meta == nil {
+				prj.meta = map[string]metaValue{}
+			}
+			prj.meta[k] = metaValue{text: v, inlines: ll, srcFN: fn}
+		}
+	}
+}
+
+// ExpandDefinitions resolves $<var:name>$ references inside definition values,
+// so that definitions can be composed from other definitions. References are
+// expanded recursively; a reference cycle or a reference to an unknown
+// variable is reported as an error.
+func (prj *Project) ExpandDefinitions() error {
+	expanded := map[string]string{}
+	for k := range prj.Definitions {
+		v, err := prj.expandDefinition(k, expanded, nil)
+		if err != nil {
+			return err
+		}
+		expanded[k] = v
+	}
+	for k, v := range expanded {
+		prj.Definitions[k] = v
+	}
+	return nil
+}
+
+// expandDefinition returns the fully expanded value of the named definition.
+// The stack holds the chain of definitions currently being expanded and is
+// used for cycle detection.
+func (prj *Project) expandDefinition(name string, expanded map[string]string, stack []string) (string, error) {
+	if v, ok := expanded[name]; ok {
+		return v, nil
+	}
+	for i, s := range stack {
+		if s == name {
+			chain := append(stack[i:], name)
+			return "", fmt.Errorf("definition cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	stack = append(stack, name)
+
+	var err error
+	v := re.ReplaceAllStringFunc(prj.Definitions[name], func(s string) string {
+		if err != nil {
+			return s
+		}
+		ref := strings.TrimSuffix(strings.TrimPrefix(s, "$<"), ">$")
+		if !strings.HasPrefix(ref, "var:") {
+			return s
+		}
+		ref = ref[len("var:"):]
+		if _, ok := prj.Definitions[ref]; !ok {
+			err = fmt.Errorf("unknown variable: %s (referenced from %s)", ref, name)
+			return s
+		}
+		var r string
+		r, err = prj.expandDefinition(ref, expanded, stack)
+		return r
+	})
+	if err != nil {
+		return "", err
+	}
+	expanded[name] = v
+	return v, nil
+}
+
+// renderMarkdownVar converts the value of the named definition from inline markdown
+// to ConTeXt markup, preserving emphasis, code, math and other inline formatting.
+// Values from the front matter of a markdown asset are rendered from the inlines
+// parsed with the asset; values from the template or the command line are parsed
+// with pandoc. Warnings are added to the project warnings. Results are cached.
+func (prj *Project) renderMarkdownVar(name string) ([]byte, error) {
+	if r, ok := prj.mdvars[name]; ok {
+		return r, nil
+	}
+	v, ok := prj.Definitions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable: %s", name)
+	}
+
+	var ll pandoc.InlineList
+	srcFN := ""
+	if m, ok := prj.meta[name]; ok && m.text == v {
+		ll, srcFN = m.inlines, m.srcFN
+	} else {
+		cmd := exec.Command("pandoc", "-f", markdownReader, "-t", "json")
+		cmd.Stdin = strings.NewReader(v)
+		jbuf, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("pandoc error in variable %s: %w", name, err)
+		}
+		d, err := loadDocument(jbuf)
+		if err != nil {
+			return nil, err
+		}
+		flow, err := d.Flow()
+		if err != nil {
+			return nil, err
+		}
+		for i, b := range flow {
+			if i > 0 {
+				ll = append(ll, &pandoc.Space{})
+			}
+			switch b := b.(type) {
+			case *pandoc.Para:
+				ll = append(ll, b.Inlines...)
+			case *pandoc.Plain:
+				ll = append(ll, b.Inlines...)
+			default:
+				return nil, fmt.Errorf("variable %s is not an inline markdown text", name)
+			}
+		}
+	}
+
+	dir := prj.MainDir
+	if srcFN != "" {
+		dir = filepath.Dir(srcFN)
+	}
+	out := bytes.Buffer{}
+	w := NewWriter(&out, dir)
+	w.SpanStyles = prj.SpanStyles
+	w.Highlight = prj.Highlight
+	w.ResourcePath = prj.ResourcePath
+	w.WriteInlines(ll)
+	for _, wrn := range w.Warnings {
+		wrn.File = srcFN
+		wrn.Pos = fmt.Sprintf("in variable %q", name)
+		prj.Warnings = append(prj.Warnings, wrn)
+	}
+
+	if prj.mdvars == nil {
+		prj.mdvars = map[string][]byte{}
+	}
+	prj.mdvars[name] = out.Bytes()
+	return prj.mdvars[name], nil
+}
+
 // replaceContent performs variable and asset path substitution on the given buffer.
-// It replaces $<var:name>$, $<template:path>$, and $<markdown:path>$ placeholders
-// with their corresponding values or file paths.
+// It replaces $<var:name>$, $<mdvar:name>$, $<template:path>$, $<markdown:path>$,
+// $<layout:name>$, and $<bibliography:>$ placeholders with their corresponding values,
+// file paths, layout setups, or the list of publications.
 func (prj *Project) replaceContent(buf []byte) []byte {
 	return re.ReplaceAllFunc(buf, func(v []byte) []byte {
 		s := string(v)
@@ -190,6 +429,13 @@ func (prj *Project) replaceContent(buf []byte) []byte {
 				} else {
 					log.Printf("unknown variable: %s\n", v)
 				}
+			case "mdvar":
+				r, err := prj.renderMarkdownVar(v)
+				if err != nil {
+					log.Print(err)
+					break
+				}
+				return r
 			case "template":
 				fn, err := normalizePath(prj.ConfigDir, v)
 				if err != nil {
@@ -215,6 +461,17 @@ func (prj *Project) replaceContent(buf []byte) []byte {
 					}
 				}
 				log.Printf("unknown markdown path: %s\n", v)
+
+			case "layout":
+				r, err := prj.renderLayout(v)
+				if err != nil {
+					log.Print(err)
+					break
+				}
+				return []byte(r)
+
+			case "bibliography":
+				return []byte("\\placelistofpublications")
 			}
 
 		}
@@ -224,11 +481,20 @@ func (prj *Project) replaceContent(buf []byte) []byte {
 
 // Process converts all assets and generates ConTeXt output files. It processes the main
 // file, template assets, and Markdown assets, writing the results to the working directory.
-// Markdown assets are converted from Pandoc AST to ConTeXt format.
+// Markdown assets are converted from Pandoc AST to ConTeXt format. Problems found in the
+// markdown assets are collected in Warnings and logged; in strict mode, they make
+// Process fail.
 func (prj *Project) Process() (err error) {
 	log.Printf("processing main file")
 
 	out := prj.replaceContent(prj.mainBuf)
+	if len(prj.Bibliography) > 0 {
+		datasets, err := prj.loadDatasets()
+		if err != nil {
+			return err
+		}
+		out = append(datasets, out...)
+	}
 	log.Printf("- writing %s\n", prj.mainDstFN)
 	err = filesystem.WriteFileIfChanged(prj.mainDstFN, out)
 	if err != nil {
@@ -249,17 +515,111 @@ func (prj *Project) Process() (err error) {
 		}
 	}
 
-	for _, f := range prj.MarkdownAssets {
+	refPrefixes := map[string]string{}
+	for k := range defaultRefPrefixes {
+		if v, ok := prj.Definitions["crossref-"+k]; ok {
+			refPrefixes[k] = v
+		}
+	}
+
+	anchors := map[string]string{}
+	type reference struct {
+		id    string
+		srcFN string
+	}
+	refs := []reference{}
+
+	flows := make([]pandoc.BlockList, len(prj.MarkdownAssets))
+	documents := map[string]*Document{}
+	namespaces := map[string]bool{}
+	for i, f := range prj.MarkdownAssets {
+		flows[i], err = f.d.Flow()
+		if err != nil {
+			return err
+		}
+		ns := ""
+		if prj.Definitions["id-namespaces"] != "false" {
+			ns = documentNamespace(f.srcFN, namespaces)
+		}
+		documents[f.srcFN] = NewDocument(flows[i], f.explicit, ns)
+	}
+
+	continueSections := prj.Definitions["continue-sections"] == "true"
+	var prev *Writer
+	for i, f := range prj.MarkdownAssets {
 		log.Printf("processing %s\n", f.srcFN)
 		out := bytes.Buffer{}
 		w := NewWriter(&out, filepath.Dir(f.srcFN))
+		if continueSections {
+			if prev != nil {
+				w.continueSections(prev)
+			}
+			w.KeepSections = i < len(prj.MarkdownAssets)-1
+		}
 		w.SetTopLevelDivision(prj.Definitions["top-heading"])
 		w.DefaultExternalFigureSize = prj.Definitions["default-externalfigure-size"]
-		flow, err := f.d.Flow()
-		if err != nil {
-			return err
+		w.Endnotes = prj.Definitions["notes"] == "endnotes"
+		w.SpanStyles = prj.SpanStyles
+		w.Highlight = prj.Highlight
+		w.ListOptions = prj.ListOptions
+		w.Headings = prj.Headings
+		w.ResourcePath = prj.ResourcePath
+		w.RefPrefixes = refPrefixes
+		w.Documents = documents
+		w.Document = documents[f.srcFN]
+		if v, ok := prj.Definitions["long-table-rows"]; ok {
+			w.LongTableRows, err = strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid long-table-rows: %w", err)
+			}
+		}
+		if v, ok := prj.Definitions["table-continued"]; ok {
+			w.TableContinued = v
+		}
+		if v := prj.Definitions["code-highlight-color"]; v != "" {
+			w.CodeHighlightColor = v
+		}
+		if v, ok := prj.Definitions["image-dpi"]; ok {
+			w.ImageDPI, err = strconv.ParseFloat(v, 64)
+			if err != nil || w.ImageDPI <= 0 {
+				return fmt.Errorf("invalid image-dpi: %s", v)
+			}
+		}
+		if v, ok := prj.Definitions["image-conversion"]; ok {
+			w.ImageConversion = v
+		}
+		if v := prj.Definitions["task-unchecked"]; v != "" {
+			w.TaskUnchecked = v
+		}
+		if v := prj.Definitions["task-checked"]; v != "" {
+			w.TaskChecked = v
+		}
+		w.notePrefix = fmt.Sprintf("fn%d:", i+1)
+		w.WriteBlocks(flows[i])
+		w.Flush()
+		prev = w
+		ids := []string{}
+		for id := range w.anchors {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if other, ok := anchors[id]; ok {
+				prj.Warnings = append(prj.Warnings, Warning{
+					File:    f.srcFN,
+					Message: "duplicate identifier '" + id + "', also defined in " + other,
+				})
+				continue
+			}
+			anchors[id] = f.srcFN
+		}
+		for _, id := range w.refs {
+			refs = append(refs, reference{id, f.srcFN})
+		}
+		for _, wrn := range w.Warnings {
+			wrn.File = f.srcFN
+			prj.Warnings = append(prj.Warnings, wrn)
 		}
-		w.WriteBlocks(flow)
 		log.Printf("- writing %s\n", f.dstFN)
 		err = filesystem.WriteFileIfChanged(f.dstFN, out.Bytes())
 		if err != nil {
@@ -267,9 +627,45 @@ func (prj *Project) Process() (err error) {
 		}
 	}
 
+	for _, r := range refs {
+		if _, ok := anchors[r.id]; !ok {
+			prj.Warnings = append(prj.Warnings, Warning{
+				File:    r.srcFN,
+				Message: "unresolved reference to '" + r.id + "'",
+			})
+		}
+	}
+
+	for _, wrn := range prj.Warnings {
+		log.Printf("warning: %s\n", wrn)
+	}
+	if prj.Strict && len(prj.Warnings) > 0 {
+		return fmt.Errorf("%d warning(s) reported in strict mode", len(prj.Warnings))
+	}
+
 	return nil
 }
 
+// loadDatasets returns the ConTeXt commands that load the bibliography files into
+// the default publication dataset. CSL-JSON files are converted to BibTeX with
+// pandoc, since ConTeXt does not read them directly.
+func (prj *Project) loadDatasets() ([]byte, error) {
+	buf := bytes.Buffer{}
+	for _, fn := range prj.Bibliography {
+		if strings.ToLower(filepath.Ext(fn)) == ".json" {
+			bib := filepath.ToSlash(filepath.Join(prj.WorkDir, strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))+".bib"))
+			log.Printf("- converting %s -> %s\n", fn, bib)
+			err := exec.Command("pandoc", "-f", "csljson", "-t", "bibtex", "-o", bib, fn).Run()
+			if err != nil {
+				return nil, fmt.Errorf("pandoc error: %w", err)
+			}
+			fn = bib
+		}
+		buf.WriteString("\\usebtxdataset[default][" + fn + "]\n")
+	}
+	return buf.Bytes(), nil
+}
+
 // BuildPDF generates a PDF file from the processed ConTeXt files by executing the
 // context command. It returns the path to the generated PDF file or an error if
 // the conversion fails.
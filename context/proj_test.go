@@ -0,0 +1,80 @@
+package context
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandDefinitions(t *testing.T) {
+	tests := []struct {
+		name string
+		defs map[string]string
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "nested",
+			defs: map[string]string{"a": "$<var:b>$ and $<var:c>$", "b": "B", "c": "<$<var:b>$>"},
+			want: map[string]string{"a": "B and <B>", "b": "B", "c": "<B>"},
+		},
+		{
+			name: "cycle",
+			defs: map[string]string{"a": "$<var:b>$", "b": "$<var:a>$"},
+			err:  "definition cycle",
+		},
+		{
+			name: "unknown",
+			defs: map[string]string{"a": "x $<var:missing>$"},
+			err:  "unknown variable: missing (referenced from a)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prj := &Project{Definitions: tt.defs}
+			err := prj.ExpandDefinitions()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if prj.Definitions[k] != v {
+					t.Errorf("%s = %q, want %q", k, prj.Definitions[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownVarFromMeta(t *testing.T) {
+	d, err := loadDocument([]byte(`{"pandoc-api-version":[1,23,1],"meta":{"title":{"t":"MetaInlines","c":[` +
+		`{"t":"Str","c":"Using"},{"t":"Space"},{"t":"Emph","c":[{"t":"Str","c":"panctx"}]},{"t":"Space"},` +
+		`{"t":"Span","c":[["",["mark"],[]],[{"t":"Str","c":"with"}]]},{"t":"Space"},{"t":"Str","c":"C++"},` +
+		`{"t":"Image","c":[["",[],[]],[],["missing.png",""]]}]}},"blocks":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prj := NewProject(t.TempDir())
+	prj.SpanStyles["mark"] = SpanStyle{Style: "bold"}
+	prj.addMeta(d, "/doc/main.md")
+	if got := prj.Definitions["title"]; got != "Using   C++" {
+		t.Fatalf("title definition = %q", got)
+	}
+
+	r, err := prj.renderMarkdownVar("title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`{\em panctx}`, `\style[bold]{with}`, `C++`} {
+		if !strings.Contains(string(r), s) {
+			t.Errorf("output does not contain %q: %s", s, r)
+		}
+	}
+	if len(prj.Warnings) != 1 || prj.Warnings[0].File != "/doc/main.md" || prj.Warnings[0].Pos != `in variable "title"` {
+		t.Errorf("warnings = %v", prj.Warnings)
+	}
+}
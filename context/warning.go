@@ -0,0 +1,100 @@
+package context
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adnsv/go-pandoc"
+)
+
+// Warning describes a problem found while converting a document, such as an
+// element that can't be rendered to ConTeXt.
+type Warning struct {
+	File    string // Source file, if known
+	Pos     string // Enclosing section, if known
+	Element string // Type of the offending element
+	Text    string // First characters of the element text
+	Message string // Description of the problem
+}
+
+// String formats the warning for logging.
+func (w Warning) String() string {
+	parts := []string{}
+	if w.File != "" {
+		parts = append(parts, w.File)
+	}
+	if w.Pos != "" {
+		parts = append(parts, w.Pos)
+	}
+	s := strings.Join(parts, ", ")
+	if s != "" {
+		s += ": "
+	}
+	s += w.Message
+	if w.Element != "" {
+		s += " [" + w.Element + "]"
+	}
+	if w.Text != "" {
+		s += fmt.Sprintf(" %q", w.Text)
+	}
+	return s
+}
+
+// maxWarningText limits the length of element text quoted in warnings.
+const maxWarningText = 40
+
+// warn records a warning about element e. Pandoc's markdown reader does not
+// report source positions, so warnings are located by the enclosing section.
+func (w *Writer) warn(e interface{}, text string, msg string) {
+	pos := ""
+	if w.section != "" {
+		pos = fmt.Sprintf("in section %q", w.section)
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > maxWarningText {
+		text = string(r[:maxWarningText]) + "..."
+	}
+	w.Warnings = append(w.Warnings, Warning{
+		Pos:     pos,
+		Element: elementType(e),
+		Text:    text,
+		Message: msg,
+	})
+}
+
+// elementType returns the Pandoc type name of an AST element.
+func elementType(e interface{}) string {
+	if e == nil {
+		return ""
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", e), "*pandoc.")
+}
+
+// blockText returns the text of a block for use in warnings.
+func blockText(b pandoc.Block) string {
+	switch b := b.(type) {
+	case *pandoc.Plain:
+		return plainText(b.Inlines)
+	case *pandoc.Para:
+		return plainText(b.Inlines)
+	case *pandoc.Header:
+		return plainText(b.Inlines)
+	case *pandoc.CodeBlock:
+		return b.Text
+	case *pandoc.RawBlock:
+		return b.Text
+	case *pandoc.Div:
+		for _, bb := range b.Blocks {
+			if s := blockText(bb); s != "" {
+				return s
+			}
+		}
+	case *pandoc.BlockQuote:
+		for _, bb := range b.Blocks {
+			if s := blockText(bb); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
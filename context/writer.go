@@ -4,30 +4,146 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/adnsv/go-pandoc"
+	"gopkg.in/yaml.v3"
 )
 
 // Writer converts Pandoc AST elements to ConTeXt markup. It maintains state during
 // conversion including block separation, inline mode, and heading levels.
 type Writer struct {
-	out         io.Writer // Output writer for ConTeXt markup
-	indir       string    // Input directory for resolving relative paths
-	blockSep    string    // Separator to insert before next block
-	forceInline int       // Counter for forcing inline image placement
-	topLevel    int       // Top-level heading mapping (0=part, 1=chapter, 2=section)
+	out         io.Writer       // Output writer for ConTeXt markup
+	indir       string          // Input directory for resolving relative paths
+	blockSep    string          // Separator to insert before next block
+	forceInline int             // Counter for forcing inline image placement
+	topLevel    int             // Top-level heading mapping (0=part, 1=chapter, 2=section)
+	tableDepth  int             // Nesting level of tables being written
+	boxDepth    int             // Nesting level of divs (stacks, columns, narrower blocks) being written
+	listDepth   int             // Nesting level of itemizations being written
+	quoteDepth  int             // Nesting level of block quotes being written
+	tableNotes  []string        // Note texts deferred until the enclosing table is placed
+	noteSeq     int             // Sequence number for generated note references
+	notePrefix  string          // Prefix for generated note references
+	pendingEnds bool            // Endnotes were written since the last \placenotes
+	anchors     map[string]bool // Identifiers of cross-reference targets written so far
+	refs        []string        // Identifiers referenced by cross-references
+	section     string          // Plain text of the last heading, used to locate warnings
+	appendices  bool            // An appendix heading started the appendices
+	sections    []openSection   // Sections started with \start<heading> and not yet stopped
+	derived     map[string]bool // Headings and floats defined on first use
+	fitFigure   bool            // Figures without size are fitted to the page (full placement)
+
+	DefaultExternalFigureSize string               // Default size constraint for external figures
+	Endnotes                  bool                 // Collect notes as endnotes placed before each top-level heading
+	SpanStyles                map[string]SpanStyle // Span class to ConTeXt style mapping
+	RefPrefixes               map[string]string    // Texts written before cross-reference numbers, by kind
+	LongTableRows             int                  // Tables with at least this many rows break across pages (0 disables)
+	TableContinued            string               // Text appended to captions on continuation pages
+	Highlight                 map[string]SpanStyle // Token class to ConTeXt style mapping for syntax highlighting
+	CodeHighlightColor        string               // Background color of highlighted code block lines
+	ListOptions               ListOptions          // Itemize options for each nesting level
+	TaskUnchecked             string               // Symbol for unchecked task list items
+	TaskChecked               string               // Symbol for checked task list items
+	Headings                  []Heading            // ConTeXt headings for markdown levels, overrides the top-level division
+	ResourcePath              []string             // Directories searched for images, after the input directory
+	ImageDPI                  float64              // Resolution used to convert pixel sizes
+	ImageConversion           string               // Default conversion option for external figures
+	Documents                 map[string]*Document // Markdown assets of the project, by absolute path
+	Document                  *Document            // Markdown asset being written, namespaces its heading identifiers
+	KeepSections              bool                 // Flush leaves the sections open, the next markdown asset continues them
+
+	Warnings []Warning // Problems found while writing, such as elements that can't be rendered
+}
+
+// SpanStyle describes how spans with a given class are rendered. Style is
+// passed to \style[...] and Color to \color[...].
+type SpanStyle struct {
+	Style string `yaml:"style"`
+	Color string `yaml:"color"`
+}
+
+// ListOptions holds additional \startitemize options for bullet and ordered
+// lists, indexed by nesting level.
+type ListOptions struct {
+	Bullet  []string `yaml:"bullet"`
+	Ordered []string `yaml:"ordered"`
+}
+
+// Heading maps a markdown heading level to ConTeXt heading commands. In the
+// template, it is either a command name or a mapping with numbered and
+// unnumbered commands.
+type Heading struct {
+	Command    string `yaml:"command"`    // Numbered heading, e.g. section
+	Unnumbered string `yaml:"unnumbered"` // Unnumbered heading, e.g. subject
+}
+
+// UnmarshalYAML accepts both the plain command name and the mapping form.
+func (h *Heading) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		h.Command = n.Value
+		return nil
+	}
+	type plain Heading
+	return n.Decode((*plain)(h))
+}
+
+// unnumbered returns the unnumbered heading command. When it is not given, it
+// is derived from the numbered command: part maps to a derived unnumbered part,
+// chapter to title, and sections to subjects.
+func (h Heading) unnumbered() string {
+	if h.Unnumbered != "" {
+		return strings.TrimPrefix(h.Unnumbered, "\\")
+	}
+	cmd := strings.TrimPrefix(h.Command, "\\")
+	switch {
+	case cmd == "chapter":
+		return "title"
+	case cmd == "part":
+		return unnumberedPart
+	case strings.HasSuffix(cmd, "section") && strings.ReplaceAll(strings.TrimSuffix(cmd, "section"), "sub", "") == "":
+		return strings.TrimSuffix(cmd, "section") + "subject"
+	}
+	return cmd
+}
 
-	DefaultExternalFigureSize string // Default size constraint for external figures
+// styleCommands returns the opening and closing markup for a SpanStyle.
+func styleCommands(st SpanStyle) (open string, close string) {
+	if st.Style != "" {
+		open += "\\style[" + st.Style + "]{"
+		close += "}"
+	}
+	if st.Color != "" {
+		open += "\\color[" + st.Color + "]{"
+		close += "}"
+	}
+	return
 }
 
 // NewWriter creates a new Writer instance that writes ConTeXt markup to w.
 // The indir parameter specifies the input directory for resolving relative image paths.
 // The default top-level heading is set to chapter (level 1).
 func NewWriter(w io.Writer, indir string) *Writer {
-	return &Writer{out: w, indir: indir, topLevel: 1}
+	return &Writer{
+		out:                w,
+		indir:              indir,
+		topLevel:           1,
+		notePrefix:         "fn:",
+		derived:            map[string]bool{},
+		TableContinued:     "(continued)",
+		CodeHighlightColor: "lightgray",
+		ImageDPI:           96,
+		ImageConversion:    "mp",
+		TaskUnchecked:      "$\\square$",
+		TaskChecked:        "$\\boxtimes$",
+	}
 }
 
 // SetTopLevelDivision sets the top-level heading division for Markdown level 1 headings.
@@ -46,9 +162,42 @@ func (w *Writer) SetTopLevelDivision(s string) {
 	}
 }
 
-// resolveImageTarget converts a relative image URL to an absolute path.
-// Relative paths are resolved relative to the input directory.
-func (w *Writer) resolveImageTarget(url string) string {
+// imageExtensions lists the extensions tried, in order, for images that are
+// referenced without one.
+var imageExtensions = []string{".pdf", ".svg", ".png", ".jpg", ".jpeg"}
+
+// resolveImageTarget converts a relative image URL to an absolute path. Relative
+// paths are searched in the input directory, then in the ResourcePath directories.
+// When the URL has no extension, the known image extensions are tried. Images
+// that can't be found are reported as warnings and resolved relative to the
+// input directory.
+func (w *Writer) resolveImageTarget(img *pandoc.Image) string {
+	url := img.Target.URL
+	if strings.Contains(url, "://") {
+		return url
+	}
+
+	dirs := []string{""}
+	if !filepath.IsAbs(url) {
+		dirs = append([]string{w.indir}, w.ResourcePath...)
+	}
+	exts := []string{""}
+	if filepath.Ext(url) == "" {
+		exts = imageExtensions
+	}
+	for _, dir := range dirs {
+		for _, ext := range exts {
+			fn := filepath.Join(dir, url+ext)
+			if st, err := os.Stat(fn); err == nil && !st.IsDir() {
+				if a, err := filepath.Abs(fn); err == nil {
+					fn = a
+				}
+				return filepath.ToSlash(fn)
+			}
+		}
+	}
+
+	w.warn(img, "", "image not found: "+url)
 	if !filepath.IsAbs(url) {
 		a, err := filepath.Abs(filepath.Join(w.indir, url))
 		if err == nil {
@@ -63,92 +212,508 @@ func (w *Writer) wr(s string) {
 	fmt.Fprint(w.out, s)
 }
 
-// makeHeading generates the appropriate ConTeXt heading command for a given Markdown
-// heading level. It adjusts the level based on the top-level division setting.
-func (w *Writer) makeHeading(lvl int) string {
-	lvl += w.topLevel
-	switch lvl {
-	case 1:
-		return "\\part"
-	case 2:
-		return "\\chapter"
+// capture runs fn with the output redirected to a buffer and returns the markup
+// written by fn. The block separator is preserved across the call.
+func (w *Writer) capture(fn func()) string {
+	out, sep := w.out, w.blockSep
+	buf := &bytes.Buffer{}
+	w.out = buf
+	w.blockSep = ""
+	fn()
+	w.out, w.blockSep = out, sep
+	return buf.String()
+}
+
+// repeat captures markup that repeats content written elsewhere, such as the
+// table of contents variant of a heading. The warnings, anchors, and references
+// recorded by fn are dropped, so that they are not reported twice.
+func (w *Writer) repeat(fn func()) string {
+	warnings, refs := len(w.Warnings), len(w.refs)
+	anchors := w.anchors
+	w.anchors = map[string]bool{}
+	for id := range anchors {
+		w.anchors[id] = true
+	}
+	s := w.capture(fn)
+	w.Warnings, w.refs, w.anchors = w.Warnings[:warnings], w.refs[:refs], anchors
+	return s
+}
+
+// noteCommand returns the name of the ConTeXt note class used for footnotes.
+func (w *Writer) noteCommand() string {
+	if w.Endnotes {
+		return "endnote"
+	}
+	return "footnote"
+}
+
+// writeNote outputs a footnote with block content. Inside tables, the note text
+// can't be typeset in place, so only a \note mark is written and the text is
+// deferred to a \footnotetext that follows the table.
+func (w *Writer) writeNote(n *pandoc.Note) {
+	text := w.capture(func() { w.WriteBlocks(n.Blocks) })
+	text = strings.TrimSpace(text)
+	cmd := w.noteCommand()
+	if w.Endnotes {
+		w.pendingEnds = true
+	}
+	if w.tableDepth > 0 {
+		w.noteSeq++
+		ref := w.notePrefix + strconv.Itoa(w.noteSeq)
+		w.wr("\\note[" + ref + "]")
+		w.tableNotes = append(w.tableNotes, "\\"+cmd+"text["+ref+"]{"+text+"}")
+		return
+	}
+	w.wr("\\" + cmd + "{" + text + "}")
+}
+
+// writeTableNotes outputs the note texts deferred while writing a table.
+func (w *Writer) writeTableNotes() {
+	for _, n := range w.tableNotes {
+		w.wr("\n" + n)
+	}
+	w.tableNotes = nil
+}
+
+// placeEndnotes outputs the endnotes collected since the last placement.
+func (w *Writer) placeEndnotes() {
+	if !w.pendingEnds {
+		return
+	}
+	w.wr("\\placenotes[endnote]")
+	w.blockSep = "\n\n"
+	w.pendingEnds = false
+}
+
+// Flush completes the output after the last block was written. In endnote mode,
+// it places the remaining endnotes, and unless KeepSections is set, it stops the
+// open sections and the appendices.
+func (w *Writer) Flush() {
+	if w.pendingEnds {
+		w.wr(w.blockSep)
+		w.placeEndnotes()
+		w.blockSep = "\n\n"
+	}
+	if w.KeepSections {
+		return
+	}
+	w.stopSections(0)
+	if w.appendices {
+		w.wr(w.blockSep)
+		w.wr("\\stopappendices")
+		w.blockSep = "\n\n"
+		w.appendices = false
+	}
+}
+
+// continueSections takes over the sections and appendices left open by the
+// writer of the previous markdown asset.
+func (w *Writer) continueSections(prev *Writer) {
+	w.sections = prev.sections
+	w.appendices = prev.appendices
+}
+
+// openSection is a heading started with \start<name> that is stopped when a
+// heading of the same or a higher level follows.
+type openSection struct {
+	name  string // Name of the ConTeXt heading
+	level int    // Markdown heading level
+}
+
+// stopSections stops open sections until n of them remain.
+func (w *Writer) stopSections(n int) {
+	for len(w.sections) > n {
+		last := w.sections[len(w.sections)-1]
+		w.wr(w.blockSep + "\\stop" + last.name)
+		w.blockSep = "\n\n"
+		w.sections = w.sections[:len(w.sections)-1]
+	}
+}
+
+// unnumberedPart is the derived heading used for unnumbered parts, ConTeXt has
+// no unnumbered counterpart of \part.
+const unnumberedPart = "unnumberedpart"
+
+// deriveHeading defines a heading derived from base, with optional settings, when
+// it is first used, and returns its name.
+func (w *Writer) deriveHeading(name, base, settings string) string {
+	if !w.derived[name] {
+		w.wr("\\definehead[" + name + "][" + base + "]")
+		if settings != "" {
+			w.wr("[" + settings + "]")
+		}
+		w.wr("\n")
+		w.derived[name] = true
+	}
+	return name
+}
+
+// defineFloat defines a float with the given plural name when it is first used.
+func (w *Writer) defineFloat(name, plural string) {
+	if !w.derived[name] {
+		w.wr("\\definefloat[" + name + "][" + plural + "]\n")
+		w.derived[name] = true
+	}
+}
+
+// maxHeadingLevel is the deepest ConTeXt heading level (part is 1,
+// subsubsubsubsubsubsubsection is 10).
+const maxHeadingLevel = 10
+
+// makeHeading returns the name of the ConTeXt heading command for a given Markdown
+// heading level. Headings mapped in the template take precedence, otherwise the
+// level is adjusted based on the top-level division setting. Levels that are too
+// deep are mapped to the deepest available heading.
+func (w *Writer) makeHeading(h *pandoc.Header, unnumbered bool) string {
+	if n := len(w.Headings); n > 0 {
+		i := h.Level - 1
+		if i >= n {
+			w.warn(h, plainText(h.Inlines), fmt.Sprintf("no heading mapped for level %d", h.Level))
+			i = n - 1
+		}
+		if unnumbered {
+			return w.Headings[i].unnumbered()
+		}
+		return strings.TrimPrefix(w.Headings[i].Command, "\\")
+	}
+
+	lvl := h.Level + w.topLevel
+	if lvl > maxHeadingLevel {
+		w.warn(h, plainText(h.Inlines), fmt.Sprintf("heading level %d is too deep", h.Level))
+		lvl = maxHeadingLevel
+	}
+	switch {
+	case lvl == 1 && unnumbered:
+		return unnumberedPart
+	case lvl == 1:
+		return "part"
+	case lvl == 2 && unnumbered:
+		return "title"
+	case lvl == 2:
+		return "chapter"
+	case unnumbered:
+		return strings.Repeat("sub", lvl-2) + "ject"
 	default:
-		if lvl < 3 || lvl > 10 {
-			return ""
+		return strings.Repeat("sub", lvl-3) + "section"
+	}
+}
+
+// headingLevel returns the level of a ConTeXt heading (part is 1, chapter and
+// title are 2, section and subject are 3, and so on), or 0 for headings that
+// are not part of the ladder.
+func headingLevel(name string) int {
+	switch name {
+	case "part", unnumberedPart:
+		return 1
+	case "chapter", "title":
+		return 2
+	}
+	for _, suffix := range []string{"section", "subject"} {
+		if prefix := strings.TrimSuffix(name, suffix); prefix != name && strings.ReplaceAll(prefix, "sub", "") == "" {
+			return 3 + len(prefix)/len("sub")
+		}
+	}
+	return 0
+}
+
+// notesLevel returns the heading level before which endnotes are placed: the
+// chapter level, or the top-level division when it is deeper.
+func (w *Writer) notesLevel() int {
+	top := w.topLevel + 1
+	if len(w.Headings) > 0 {
+		top = headingLevel(strings.TrimPrefix(w.Headings[0].Command, "\\"))
+	}
+	if top < 2 {
+		return 2
+	}
+	return top
+}
+
+// writeHeader writes a heading. Headings start sections with \start<heading>,
+// which are stopped by the next heading of the same or a higher level, or by
+// Flush; headings nested in divs, lists, tables, or block quotes use the
+// \<heading> form instead. Unnumbered headings use the title and subject
+// commands, unlisted headings use a derived heading that is not part of the table
+// of contents, and the first appendix heading starts the appendices. The
+// appendices enclose sections, so they are only started by a heading at the
+// top level of sectioning.
+func (w *Writer) writeHeader(h *pandoc.Header) {
+	w.section = plainText(h.Inlines)
+	unnumbered := h.Attr.HasClass("unnumbered")
+	name := w.makeHeading(h, unnumbered)
+	level := headingLevel(name)
+	if w.pendingEnds && (level > 0 && level <= w.notesLevel() || level == 0 && h.Level == 1) {
+		w.placeEndnotes()
+		w.wr(w.blockSep)
+	}
+	nested := w.boxDepth > 0 || w.listDepth > 0 || w.tableDepth > 0 || w.quoteDepth > 0
+	if !nested {
+		n := len(w.sections)
+		for n > 0 && w.sections[n-1].level >= h.Level {
+			n--
+		}
+		w.blockSep = ""
+		w.stopSections(n)
+		w.wr(w.blockSep)
+	}
+	if h.Attr.HasClass("appendix") && !w.appendices {
+		if nested || len(w.sections) > 0 {
+			w.warn(h, w.section, "appendix heading is not at the top level, the appendices are not started")
+		} else {
+			w.wr("\\startappendices\n\n")
+			w.appendices = true
+		}
+	}
+
+	if name == unnumberedPart {
+		w.deriveHeading(name, "part", "number=no,incrementnumber=no")
+	}
+	if h.Attr.HasClass("unlisted") && !unnumbered {
+		name = w.deriveHeading("unlisted"+name, name, "")
+	}
+
+	options := []string{}
+	if h.Attr.Identifier != "" {
+		options = append(options, "reference="+w.anchor(h.Attr.Identifier))
+	}
+	options = append(options, w.headingTitles(h)...)
+	if nested {
+		w.wr("\\" + name + "[" + strings.Join(options, ",") + "]")
+		return
+	}
+	w.wr("\\start" + name + "[" + strings.Join(options, ",") + "]")
+	w.sections = append(w.sections, openSection{name, h.Level})
+}
+
+// headingTitles returns the title options of a heading. The title has the full
+// markup, the list entry (table of contents) leaves out notes and links, and the
+// bookmark and marking (running headers) are plain text. A toc-title attribute
+// gives a short title for the list, bookmark, and marking. Variants that are the
+// same as the title are omitted.
+func (w *Writer) headingTitles(h *pandoc.Header) []string {
+	title := w.capture(func() { w.WriteInlines(h.Inlines) })
+	list := title
+	plain := strings.Join(strings.Fields(FlattenInlines(h.Inlines)), " ")
+	if short := h.Attr.KeyValMap()["toc-title"]; short != "" {
+		list = EscapeStr(short)
+		plain = list
+	} else if ll, changed := listInlines(h.Inlines); changed {
+		list = w.repeat(func() { w.WriteInlines(ll) })
+	}
+	ret := []string{"title={" + title + "}"}
+	if list != title {
+		ret = append(ret, "list={"+list+"}")
+	}
+	if plain != title {
+		ret = append(ret, "bookmark={"+plain+"}", "marking={"+plain+"}")
+	}
+	return ret
+}
+
+// listInlines returns a copy of heading text for the table of contents, without
+// notes, links (their text is kept), and span identifiers. It also reports
+// whether anything was left out.
+func listInlines(ll pandoc.InlineList) (pandoc.InlineList, bool) {
+	ret := pandoc.InlineList{}
+	changed := false
+	for _, l := range ll {
+		switch l := l.(type) {
+		case *pandoc.Note:
+			changed = true
+		case *pandoc.Link:
+			content, _ := listInlines(l.Content)
+			ret = append(ret, content...)
+			changed = true
+		case *pandoc.Formatted:
+			content, c := listInlines(l.Content)
+			ret = append(ret, &pandoc.Formatted{Fmt: l.Fmt, Content: content})
+			changed = changed || c
+		case *pandoc.Quoted:
+			content, c := listInlines(l.Content)
+			ret = append(ret, &pandoc.Quoted{QuoteType: l.QuoteType, Content: content})
+			changed = changed || c
+		case *pandoc.Span:
+			attr := l.Attr
+			attr.Identifier = ""
+			content, c := listInlines(l.Content)
+			ret = append(ret, &pandoc.Span{Attr: attr, Content: content})
+			changed = changed || c || l.Attr.Identifier != ""
+		default:
+			ret = append(ret, l)
 		}
-		return "\\" + strings.Repeat("sub", lvl-3) + "section"
+	}
+	return ret, changed
+}
+
+// contextAlign maps a Pandoc alignment to a ConTeXt align option.
+func contextAlign(a string) string {
+	switch a {
+	case "AlignLeft":
+		return "flushleft"
+	case "AlignCenter":
+		return "middle"
+	case "AlignRight":
+		return "flushright"
+	default:
+		return ""
 	}
 }
 
-// writeRow outputs a table row with the specified style. It handles cell alignment
-// and column spanning using ConTeXt's xtable system.
-func (w *Writer) writeRow(table *pandoc.Table, row *pandoc.Row, style string) {
+// writeRow outputs a table row with the specified style. It maps cell spans to
+// nx and ny, cell or column alignment to align, and relative column widths to
+// width options of ConTeXt's xtable system. The occupied slice tracks, for each
+// column, the number of rows still covered by cells spanning from earlier rows.
+func (w *Writer) writeRow(table *pandoc.Table, row *pandoc.Row, style string, occupied *[]int) {
 	if style != "" {
 		style = "[" + style + "]"
 	}
 	w.wr("\\startxrow" + style)
-	for i, c := range row.Cells {
+	col := 0
+	for _, c := range row.Cells {
+		for col < len(*occupied) && (*occupied)[col] > 0 {
+			col++
+		}
+		nx, ny := c.ColSpan, c.RowSpan
+		if nx < 1 {
+			nx = 1
+		}
+		if ny < 1 {
+			ny = 1
+		}
+		for len(*occupied) < col+nx {
+			*occupied = append(*occupied, 0)
+		}
+		for i := col; i < col+nx; i++ {
+			(*occupied)[i] = ny
+		}
+
 		styles := []string{}
-		alignmentHack := ""
-		if i < len(table.ColSpecs) {
-			switch table.ColSpecs[i].Alignment {
-			case "AlignCenter":
-				alignmentHack = "\u200B" // zero-width space
-				styles = append(styles, "align=center")
-			case "AlignRight":
-				alignmentHack = "\u200B" // zero-width space
-				styles = append(styles, "align=flushright")
+		if nx > 1 {
+			styles = append(styles, "nx="+strconv.Itoa(nx))
+		}
+		if ny > 1 {
+			styles = append(styles, "ny="+strconv.Itoa(ny))
+		}
+		align := contextAlign(c.Alignment)
+		if align == "" && col < len(table.ColSpecs) {
+			align = contextAlign(table.ColSpecs[col].Alignment)
+		}
+		if align != "" {
+			styles = append(styles, "align="+align)
+		}
+		width := float32(0)
+		for i := col; i < col+nx; i++ {
+			if i >= len(table.ColSpecs) || table.ColSpecs[i].ColWidth <= 0 {
+				width = 0
+				break
 			}
+			width += table.ColSpecs[i].ColWidth
 		}
+		if width > 0 {
+			styles = append(styles, fmt.Sprintf("width=%.4f\\textwidth", width))
+		}
+
 		sty := ""
 		if len(styles) > 0 {
 			sty = "[" + strings.Join(styles, ",") + "]"
 		}
 		w.wr("\n\\startxcell" + sty)
-		w.blockSep = "\n" + alignmentHack
+		w.blockSep = "\n"
 		w.WriteBlocks(c.Blocks)
 		w.wr("\n\\stopxcell")
+		col += nx
 	}
 	w.wr("\n\\stopxrow")
+	for i := range *occupied {
+		if (*occupied)[i] > 0 {
+			(*occupied)[i]--
+		}
+	}
 }
 
 // writeTable converts a Pandoc table to ConTeXt's xtable format. It handles table
 // headers, bodies, footers, and captions.
 func (w *Writer) writeTable(table *pandoc.Table) {
-	w.wr("\\startplacetable[")
-	if table.Caption == nil {
-		w.wr("location={here,none}")
+	w.tableDepth++
+	setColWidths(table)
+	captionAttr(table)
+	kv := table.Attr.KeyValMap()
+
+	rows := 0
+	for _, tb := range table.Bodies {
+		rows += len(tb.Rows2)
+	}
+	long := table.Attr.HasClass("long") || kv["split"] == "yes" ||
+		(w.LongTableRows > 0 && rows >= w.LongTableRows)
+	if kv["split"] == "no" {
+		long = false
+	}
+
+	options := []string{}
+	if id := table.Attr.Identifier; id != "" {
+		options = append(options, "reference="+w.anchor(id))
+	}
+	location := "here"
+	if long {
+		location = "split,here"
+	}
+	title := ""
+	if len(table.Caption) == 0 {
+		options = append(options, "location={"+location+",none}")
 	} else {
-		w.wr("title={")
 		// looks pandoc produces a single Plain element here
-		w.blockSep = ""
-		w.WriteBlocks(table.Caption)
-		w.wr("}")
+		title = strings.TrimSpace(w.capture(func() { w.WriteBlocks(table.Caption) }))
+		if long {
+			options = append(options, "location={"+location+"}")
+		}
+		options = append(options, "title={"+title+"}")
 	}
-	w.wr("]")
+	w.wr("\\startplacetable[" + strings.Join(options, ",") + "]")
 	w.forceInline++
-	w.wr("\n\\startxtable")
-	if len(table.Head.Rows) > 0 {
-		w.wr("\n\\startxtablehead")
+	if long {
+		w.wr("\n\\startxtable[split=yes,header=repeat,footer=repeat]")
+	} else {
+		w.wr("\n\\startxtable")
+	}
+	// the head rows are written once and repeated on continuation pages, so
+	// that their notes and references are recorded only once
+	head := w.capture(func() {
+		occupied := []int{}
 		for _, r := range table.Head.Rows {
 			w.wr("\n")
-			w.writeRow(table, r, "head")
+			w.writeRow(table, r, "head", &occupied)
 		}
+	})
+	if len(table.Head.Rows) > 0 {
+		w.wr("\n\\startxtablehead")
+		w.wr(head)
 		w.wr("\n\\stopxtablehead")
 	}
+	if long && (title != "" || len(table.Head.Rows) > 0) {
+		// the head used on continuation pages
+		w.wr("\n\\startxtablenext")
+		if title != "" {
+			w.wr("\n\\startxrow\n\\startxcell[nx=" + strconv.Itoa(len(table.ColSpecs)) + ",frame=off]")
+			w.wr("\n{\\em " + title + " " + EscapeStr(w.TableContinued) + "}")
+			w.wr("\n\\stopxcell\n\\stopxrow")
+		}
+		w.wr(head)
+		w.wr("\n\\stopxtablenext")
+	}
 
 	for j, tb := range table.Bodies {
 		// todo: figure out how exactly pandoc works here
 		w.wr("\n\\startxtablebody")
+		occupied := []int{}
 		for i, r := range tb.Rows2 {
 			w.wr("\n")
 
 			last := j == len(table.Bodies)-1 && i == len(tb.Rows2)-1
 
 			if last {
-				w.writeRow(table, r, "lastbody")
+				w.writeRow(table, r, "lastbody", &occupied)
 			} else {
-				w.writeRow(table, r, "body")
+				w.writeRow(table, r, "body", &occupied)
 			}
 		}
 		w.wr("\n\\stopxtablebody")
@@ -156,15 +721,149 @@ func (w *Writer) writeTable(table *pandoc.Table) {
 
 	if len(table.Foot.Rows) > 0 {
 		w.wr("\n\\startxtablefoot")
+		occupied := []int{}
 		for _, r := range table.Foot.Rows {
 			w.wr("\n")
-			w.writeRow(table, r, "foot")
+			w.writeRow(table, r, "foot", &occupied)
 		}
 		w.wr("\n\\stopxtablefoot")
 	}
 	w.wr("\n\\stopxtable")
 	w.forceInline--
 	w.wr("\n\\stopplacetable")
+	if notes := kv["notes"]; notes != "" {
+		w.wr("\n{\\tfx " + EscapeStr(notes) + "\\par}")
+	}
+	w.tableDepth--
+	if w.tableDepth == 0 {
+		w.writeTableNotes()
+	}
+}
+
+// captionAttr moves a trailing attribute block ({#tbl:id .long key=value}) from
+// the table caption into the table attributes.
+func captionAttr(table *pandoc.Table) {
+	if len(table.Caption) != 1 {
+		return
+	}
+	var ll *pandoc.InlineList
+	switch b := table.Caption[0].(type) {
+	case *pandoc.Plain:
+		ll = &b.Inlines
+	case *pandoc.Para:
+		ll = &b.Inlines
+	default:
+		return
+	}
+	start := -1
+	for i := len(*ll) - 1; i >= 0; i-- {
+		if s, ok := (*ll)[i].(*pandoc.Str); ok && strings.HasPrefix(s.Text, "{") {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return
+	}
+	text := plainText((*ll)[start:])
+	if !strings.HasSuffix(text, "}") {
+		return
+	}
+	attr, ok := parseAttr(text[1 : len(text)-1])
+	if !ok {
+		return
+	}
+	if attr.Identifier != "" {
+		table.Attr.Identifier = attr.Identifier
+	}
+	table.Attr.Classes = append(table.Attr.Classes, attr.Classes...)
+	table.Attr.KeyVals = append(table.Attr.KeyVals, attr.KeyVals...)
+	*ll = (*ll)[:start]
+	for len(*ll) > 0 {
+		if _, ok := (*ll)[len(*ll)-1].(*pandoc.Space); !ok {
+			break
+		}
+		*ll = (*ll)[:len(*ll)-1]
+	}
+	if len(*ll) == 0 {
+		table.Caption = nil
+	}
+}
+
+// plainText converts inlines to unescaped plain text, keeping quotes.
+func plainText(ll pandoc.InlineList) string {
+	buf := &strings.Builder{}
+	for _, l := range ll {
+		switch l := l.(type) {
+		case *pandoc.Space, *pandoc.SoftBreak, *pandoc.LineBreak:
+			buf.WriteString(" ")
+		case *pandoc.Str:
+			buf.WriteString(l.Text)
+		case *pandoc.Quoted:
+			q := "\""
+			if l.QuoteType == "SingleQuote" {
+				q = "'"
+			}
+			buf.WriteString(q + plainText(l.Content) + q)
+		case *pandoc.Formatted:
+			buf.WriteString(plainText(l.Content))
+		case *pandoc.Code:
+			buf.WriteString(l.Text)
+		case *pandoc.Math:
+			buf.WriteString(l.Text)
+		case *pandoc.Span:
+			buf.WriteString(plainText(l.Content))
+		case *pandoc.Link:
+			buf.WriteString(plainText(l.Content))
+		}
+	}
+	return buf.String()
+}
+
+// parseAttr parses a pandoc attribute specification (#id .class key=value,
+// with optionally quoted values).
+func parseAttr(s string) (attr pandoc.Attr, ok bool) {
+	s = strings.TrimSpace(s)
+	for s != "" {
+		n := strings.IndexAny(s, " \t\n=")
+		if n < 0 {
+			n = len(s)
+		}
+		tok := s[:n]
+		s = s[n:]
+		switch {
+		case strings.HasPrefix(s, "="):
+			s = s[1:]
+			val := ""
+			if strings.HasPrefix(s, "\"") {
+				end := strings.IndexByte(s[1:], '"')
+				if end < 0 {
+					return attr, false
+				}
+				val, s = s[1:end+1], s[end+2:]
+			} else {
+				end := strings.IndexAny(s, " \t\n")
+				if end < 0 {
+					end = len(s)
+				}
+				val, s = s[:end], s[end:]
+			}
+			if tok == "" {
+				return attr, false
+			}
+			attr.KeyVals = append(attr.KeyVals, &pandoc.KeyVal{Key: tok, Val: val})
+		case strings.HasPrefix(tok, "#") && len(tok) > 1:
+			attr.Identifier = tok[1:]
+		case strings.HasPrefix(tok, ".") && len(tok) > 1:
+			attr.Classes = append(attr.Classes, tok[1:])
+		case tok == "-":
+			attr.Classes = append(attr.Classes, "unnumbered")
+		default:
+			return attr, false
+		}
+		s = strings.TrimSpace(s)
+	}
+	return attr, true
 }
 
 // writeDiv processes Pandoc Div blocks with special class handling for layout features.
@@ -174,6 +873,14 @@ func (w *Writer) writeDiv(div *pandoc.Div) {
 	kv := div.Attr.KeyValMap()
 	w.blockSep = ""
 
+	if div.Attr.HasClass(classFigure) {
+		w.writeFigure(div)
+		return
+	}
+
+	w.boxDepth++
+	defer func() { w.boxDepth-- }()
+
 	if div.Attr.HasClass("HSTACK") {
 		w.wr("\\startxtable\\startxrow\\startxcell")
 		w.blockSep = "\n"
@@ -197,12 +904,7 @@ func (w *Writer) writeDiv(div *pandoc.Div) {
 	}
 
 	if c := kv["combination"]; c != "" {
-		w.wr("\\startcombination[" + c + "]")
-		w.blockSep = "\n"
-		w.forceInline++
-		w.WriteBlocks(div.Blocks)
-		w.forceInline--
-		w.wr("\n\\stopcombination")
+		w.writeCombinationDiv(div, c)
 	} else if c = kv["columns"]; c != "" {
 		w.wr("\\startcolumns[" + c + "]")
 		w.blockSep = "\n"
@@ -328,17 +1030,11 @@ func (w *Writer) writeBlock(b pandoc.Block) {
 		w.blockSep = "\n\n"
 
 	case *pandoc.CodeBlock:
-		w.wr("\\starttyping")
-		if len(b.Attr.Classes) > 0 {
-			lang := b.Attr.Classes[0]
-			w.wr("[option=" + lang + "]")
-		}
-		w.wr("\n")
-		w.wr(b.Text)
-		w.wr("\n\\stoptyping")
+		w.writeCodeBlock(b)
 		w.blockSep = "\n\n"
 
 	case *pandoc.BlockQuote:
+		w.quoteDepth++
 		// Check for GitHub-style alerts first
 		if !w.handleAlert(b.Blocks) {
 			// Fall back to standard blockquote
@@ -347,28 +1043,28 @@ func (w *Writer) writeBlock(b pandoc.Block) {
 			w.WriteBlocks(b.Blocks)
 			w.wr("\n\\stopblockquote")
 		}
+		w.quoteDepth--
 		w.blockSep = "\n\n"
 
 	case *pandoc.OrderedList:
-		w.wr("\\startitemize[n,packed][stopper=.]")
-		for _, bb := range b.Items {
-			w.wr("\n\\item\n")
-			w.blockSep = ""
-			w.WriteBlocks(bb)
-			w.blockSep = "\n\n"
+		options := []string{orderedConversion(b.NumberStyle)}
+		settings := []string{}
+		if b.StartNumber != 1 {
+			settings = append(settings, "start="+strconv.Itoa(b.StartNumber))
 		}
-		w.wr("\n\\stopitemize")
+		switch b.NumberDelim {
+		case "OneParen":
+			settings = append(settings, "stopper=)")
+		case "TwoParens":
+			settings = append(settings, "left=(", "stopper=)")
+		default:
+			settings = append(settings, "stopper=.")
+		}
+		w.writeItemize(b.Items, options, settings, w.ListOptions.Ordered)
 		w.blockSep = "\n\n"
 
 	case *pandoc.BulletList:
-		w.wr("\\startitemize")
-		for _, bb := range b.Items {
-			w.wr("\n\\item\n")
-			w.blockSep = ""
-			w.WriteBlocks(bb)
-			w.blockSep = "\n\n"
-		}
-		w.wr("\n\\stopitemize")
+		w.writeItemize(b.Items, nil, nil, w.ListOptions.Bullet)
 		w.blockSep = "\n\n"
 
 	case *pandoc.DefinitionList:
@@ -388,13 +1084,7 @@ func (w *Writer) writeBlock(b pandoc.Block) {
 		}
 
 	case *pandoc.Header:
-		w.wr(w.makeHeading(b.Level))
-		if b.Attr.Identifier != "" {
-			w.wr("[" + b.Attr.Identifier + "]")
-		}
-		w.wr("{")
-		w.WriteInlines(b.Inlines)
-		w.wr("}")
+		w.writeHeader(b)
 		w.blockSep = "\n\n"
 
 	case *pandoc.HorizontalRule:
@@ -410,35 +1100,284 @@ func (w *Writer) writeBlock(b pandoc.Block) {
 		w.blockSep = "\n\n"
 
 	case *pandoc.RawBlock:
-		if b.Format == "tex" {
+		if (b.Format == "tex" || b.Format == "latex") && isMathEnvironment(b.Text) {
+			w.writeDisplayMath(b, b.Text, "")
+			w.blockSep = "\n\n"
+		} else if b.Format == "tex" || b.Format == "context" || b.Format == "latex" {
+			if env := latexEnvironment(b.Text); env != "" {
+				w.warn(b, b.Text, "unsupported LaTeX environment "+env)
+			}
 			w.wr(b.Text)
 			w.blockSep = "\n\n"
+		} else if b.Format != "html" || !isHTMLComment(b.Text) {
+			w.warn(b, b.Text, "unsupported raw block format '"+b.Format+"'")
 		}
 
 	default:
+		w.warn(b, blockText(b), "unsupported block element")
 		w.blockSep = ""
 	}
 }
 
-// WriteBlocks converts a sequence of Pandoc blocks to ConTeXt markup, inserting
-// appropriate block separators between elements.
-func (w *Writer) WriteBlocks(bb []pandoc.Block) {
-	for _, b := range bb {
-		w.wr(w.blockSep)
-		w.writeBlock(b)
-	}
+// isHTMLComment reports whether raw HTML consists of a comment, which is
+// dropped without a warning.
+func isHTMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "<!--") && strings.HasSuffix(s, "-->")
 }
 
-// writeExternalFigure generates a ConTeXt \externalfigure command for an image.
-// It handles image paths, size constraints, and offset positioning.
-func (w *Writer) writeExternalFigure(img *pandoc.Image) {
-	fn := img.Target.URL
-	fn = w.resolveImageTarget(fn)
-	ext := strings.ToLower(filepath.Ext(fn))
+// orderedConversion returns the ConTeXt itemize conversion for a Pandoc list
+// number style.
+func orderedConversion(style string) string {
+	switch style {
+	case "LowerRoman":
+		return "r"
+	case "UpperRoman":
+		return "R"
+	case "LowerAlpha":
+		return "a"
+	case "UpperAlpha":
+		return "A"
+	default:
+		return "n"
+	}
+}
 
-	kv := img.Attr.KeyValMap()
-	if dx, dy := kv["dx"], kv["dy"]; dx != "" || dy != "" {
-		w.wr("\\offset[")
+// isTight reports whether list items are tight, that is, they hold Plain
+// rather than Para blocks.
+func isTight(items []pandoc.BlockList) bool {
+	for _, bb := range items {
+		if len(bb) > 0 {
+			if _, ok := bb[0].(*pandoc.Para); ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// taskItem detects GFM task list items, which start with a ballot box
+// character. It returns the item blocks without the box.
+func taskItem(bb pandoc.BlockList) (checked bool, rest pandoc.BlockList, ok bool) {
+	if len(bb) == 0 {
+		return
+	}
+	var ll pandoc.InlineList
+	switch b := bb[0].(type) {
+	case *pandoc.Plain:
+		ll = b.Inlines
+	case *pandoc.Para:
+		ll = b.Inlines
+	}
+	if len(ll) < 2 {
+		return
+	}
+	box, _ := ll[0].(*pandoc.Str)
+	if _, space := ll[1].(*pandoc.Space); box == nil || !space {
+		return
+	}
+	switch box.Text {
+	case "☐":
+	case "☒":
+		checked = true
+	default:
+		return
+	}
+	var first pandoc.Block
+	switch bb[0].(type) {
+	case *pandoc.Plain:
+		first = &pandoc.Plain{Inlines: ll[2:]}
+	case *pandoc.Para:
+		first = &pandoc.Para{Inlines: ll[2:]}
+	}
+	rest = append(pandoc.BlockList{first}, bb[1:]...)
+	return checked, rest, true
+}
+
+// writeItemize writes the items of a bullet or ordered list. Tight lists are
+// packed, task list items get checkbox symbols, and the template options for
+// the nesting level are added to the itemize options.
+func (w *Writer) writeItemize(items []pandoc.BlockList, options, settings, levels []string) {
+	if isTight(items) {
+		options = append(options, "packed")
+	}
+	if w.listDepth < len(levels) && levels[w.listDepth] != "" {
+		options = append(options, levels[w.listDepth])
+	}
+	w.wr("\\startitemize")
+	if len(options) > 0 || len(settings) > 0 {
+		w.wr("[" + strings.Join(options, ",") + "]")
+	}
+	if len(settings) > 0 {
+		w.wr("[" + strings.Join(settings, ",") + "]")
+	}
+	w.listDepth++
+	for _, bb := range items {
+		if checked, rest, ok := taskItem(bb); ok {
+			sym := w.TaskUnchecked
+			if checked {
+				sym = w.TaskChecked
+			}
+			w.wr("\n\\sym{" + sym + "}\n")
+			bb = rest
+		} else {
+			w.wr("\n\\item\n")
+		}
+		w.blockSep = ""
+		w.WriteBlocks(bb)
+	}
+	w.listDepth--
+	w.wr("\n\\stopitemize")
+}
+
+// codeLanguage returns the language of a code block or inline code, that is
+// the first class that is not a code block option.
+func codeLanguage(attr pandoc.Attr) string {
+	for _, c := range attr.Classes {
+		switch c {
+		case "numberLines", "number-lines", "wrap":
+		default:
+			return c
+		}
+	}
+	return ""
+}
+
+// parseLineRanges parses a list of line numbers and ranges, e.g. "3-5,8". Ranges
+// are clamped to the number of lines in the code block.
+func parseLineRanges(s string, lines int) (map[int]bool, error) {
+	ret := map[int]bool{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		first, last, isRange := strings.Cut(r, "-")
+		a, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("invalid line range '%s'", r)
+		}
+		b := a
+		if isRange {
+			b, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil || b < a {
+				return nil, fmt.Errorf("invalid line range '%s'", r)
+			}
+		}
+		if b > lines {
+			b = lines
+		}
+		for i := a; i <= b; i++ {
+			ret[i] = true
+		}
+	}
+	return ret, nil
+}
+
+// writeCodeBlock converts a code block. Blocks with a caption or an identifier
+// are placed in a listing float. Plain blocks are written with \starttyping,
+// blocks that use syntax highlighting, line numbers, highlighted lines, or
+// wrapping are written line by line in a \startlines environment.
+func (w *Writer) writeCodeBlock(b *pandoc.CodeBlock) {
+	kv := b.Attr.KeyValMap()
+	lang := codeLanguage(b.Attr)
+
+	numbered := b.Attr.HasClass("numberLines") || b.Attr.HasClass("number-lines")
+	start := 0
+	if s := kv["startFrom"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			w.warn(b, b.Text, "invalid startFrom value '"+s+"'")
+		} else {
+			start = n
+		}
+	}
+	var marked map[int]bool
+	if s := kv["highlight"]; s != "" {
+		var err error
+		marked, err = parseLineRanges(s, strings.Count(b.Text, "\n")+1)
+		if err != nil {
+			w.warn(b, b.Text, err.Error())
+		}
+	}
+	wrap := kv["wrap"] == "true" || b.Attr.HasClass("wrap")
+
+	id := b.Attr.Identifier
+	caption := kv["caption"]
+	if id != "" || caption != "" {
+		options := []string{}
+		if id != "" {
+			options = append(options, "reference="+w.anchor(id))
+		}
+		if caption != "" {
+			options = append(options, "title={"+EscapeStr(caption)+"}")
+		} else {
+			options = append(options, "location=none")
+		}
+		w.defineFloat("listing", "listings")
+		w.wr("\\startplacelisting[" + strings.Join(options, ",") + "]\n")
+	}
+
+	code, highlighted := highlight(expandTabs(b.Text, 4), lang, w.Highlight)
+	if (!highlighted || len(w.Highlight) == 0) && !numbered && len(marked) == 0 && !wrap {
+		w.wr("\\starttyping")
+		if lang != "" {
+			w.wr("[option=" + lang + "]")
+		}
+		w.wr("\n")
+		w.wr(b.Text)
+		w.wr("\n\\stoptyping")
+	} else {
+		if numbered {
+			w.wr("\\startlinenumbering")
+			if start != 0 {
+				w.wr("[start=" + strconv.Itoa(start) + "]")
+			}
+			w.wr("\n")
+		}
+		w.wr("\\startlines[style=mono,space=on]\n")
+		for i, line := range strings.Split(code, "\n") {
+			if i > 0 {
+				w.wr("\n")
+			}
+			switch {
+			case marked[i+1]:
+				if line == "" {
+					line = "\\strut"
+				}
+				w.wr("\\backgroundline[" + w.CodeHighlightColor + "]{" + line + "}")
+			case line != "" && !wrap:
+				w.wr("\\hbox{" + line + "}")
+			default:
+				w.wr(line)
+			}
+		}
+		w.wr("\n\\stoplines")
+		if numbered {
+			w.wr("\n\\stoplinenumbering")
+		}
+	}
+
+	if id != "" || caption != "" {
+		w.wr("\n\\stopplacelisting")
+	}
+}
+
+// WriteBlocks converts a sequence of Pandoc blocks to ConTeXt markup, inserting
+// appropriate block separators between elements.
+func (w *Writer) WriteBlocks(bb []pandoc.Block) {
+	for _, b := range bb {
+		w.wr(w.blockSep)
+		w.writeBlock(b)
+	}
+}
+
+// writeExternalFigure generates a ConTeXt \externalfigure command for an image.
+// It handles image paths, size constraints, and offset positioning.
+func (w *Writer) writeExternalFigure(img *pandoc.Image) {
+	fn := w.resolveImageTarget(img)
+	ext := strings.ToLower(filepath.Ext(fn))
+
+	kv := img.Attr.KeyValMap()
+	if dx, dy := kv["dx"], kv["dy"]; dx != "" || dy != "" {
+		w.wr("\\offset[")
 		if dx != "" {
 			w.wr(fmt.Sprintf("x=%s", dx))
 			if dy != "" {
@@ -451,53 +1390,124 @@ func (w *Writer) writeExternalFigure(img *pandoc.Image) {
 		w.wr("]")
 	}
 
-	w.wr("{\\externalfigure[")
+	rotation := ""
+	if s := kv["angle"]; s != "" {
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			w.warn(img, "", "invalid image angle '"+s+"'")
+		} else {
+			rotation = s
+		}
+	}
+
+	w.wr("{")
+	if rotation != "" {
+		w.wr("\\rotate[rotation=" + rotation + "]{")
+	}
+	w.wr("\\externalfigure[")
 	w.wr(fn)
 	w.wr("]")
 	attrs := []string{}
-	attrs = append(attrs, "conversion=mp")
-
-	haveWidth := false
-	haveHeight := false
-	if len(kv) > 0 {
-		if s := kv["width"]; s != "" {
-			n, u, err := splitNumUnits(s)
-			if err == nil {
-				switch u {
-				case "%":
-					u = "\\textwidth"
-					n /= 100.0
-				case "inch":
-					u = "in"
-				}
-				attrs = append(attrs, fmt.Sprintf("width=%f%s", n, u))
-			}
-			haveWidth = true
-		}
-		if s := kv["height"]; s != "" {
-			n, u, err := splitNumUnits(s)
-			if err == nil {
-				switch u {
-				case "%":
-					u = "\\textheight"
-					n /= 100.0
-				case "inch":
-					u = "in"
-				}
-				attrs = append(attrs, fmt.Sprintf("height=%f%s", n, u))
-			}
-			haveWidth = true
+	conversion := w.ImageConversion
+	if s, ok := kv["conversion"]; ok {
+		conversion = s
+	}
+	if conversion != "" && conversion != "none" {
+		attrs = append(attrs, "conversion="+conversion)
+	}
+	attrs = append(attrs, w.figureOptions(img, kv)...)
+
+	haveSize := false
+	for _, k := range []string{"width", "height"} {
+		s := kv[k]
+		if s == "" {
+			continue
+		}
+		haveSize = true
+		d, err := w.imageDimension(s, k == "width")
+		if err != nil {
+			w.warn(img, "", "invalid image "+k+" '"+s+"': "+err.Error())
+			continue
 		}
+		attrs = append(attrs, k+"="+d)
 	}
-	if !haveWidth && !haveHeight && ext != ".svg" && w.DefaultExternalFigureSize != "" {
+	if s := kv["scale"]; s != "" {
+		haveSize = true
+		if v, err := imageScale(s); err != nil {
+			w.warn(img, "", "invalid image scale: "+err.Error())
+		} else {
+			attrs = append(attrs, "scale="+v)
+		}
+	}
+	if !haveSize && w.fitFigure {
+		attrs = append(attrs, "factor=fit")
+	} else if !haveSize && ext != ".svg" && w.DefaultExternalFigureSize != "" {
 		attrs = append(attrs, w.DefaultExternalFigureSize)
 	}
 	if len(attrs) > 0 {
 		w.wr("[" + strings.Join(attrs, ",") + "]")
 	}
+	if rotation != "" {
+		w.wr("}")
+	}
 	w.wr("}")
 }
 
+// figureOptions returns the \externalfigure options for the page, clip, frame,
+// and background image attributes. Invalid values are reported as warnings.
+func (w *Writer) figureOptions(img *pandoc.Image, kv map[string]string) []string {
+	ret := []string{}
+	if s := kv["page"]; s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			w.warn(img, "", "invalid image page '"+s+"'")
+		} else {
+			ret = append(ret, "page="+s)
+		}
+	}
+	if s := kv["clip"]; s != "" {
+		switch s {
+		case "true", "yes", "trim":
+			ret = append(ret, "size=trim")
+		case "media", "crop", "bleed", "art":
+			ret = append(ret, "size="+s)
+		case "false", "no":
+		default:
+			w.warn(img, "", "invalid image clip '"+s+"': expected trim, crop, bleed, art, or media")
+		}
+	}
+	if s := kv["frame"]; s != "" {
+		switch s {
+		case "on", "off":
+			ret = append(ret, "frame="+s)
+		default:
+			w.warn(img, "", "invalid image frame '"+s+"': expected on or off")
+		}
+	}
+	if s := kv["background"]; s != "" {
+		ret = append(ret, "background=color", "backgroundcolor="+s)
+	}
+	return ret
+}
+
+var rePageSelection = regexp.MustCompile(`^(odd|even|\d+(-\d+)?)(,(odd|even|\d+(-\d+)?))*$`)
+
+// writePages inserts whole pages of an external PDF document: all pages with
+// \copypages, or the pages listed in the pages attribute with \filterpages.
+func (w *Writer) writePages(img *pandoc.Image) {
+	fn := w.resolveImageTarget(img)
+	if strings.ToLower(filepath.Ext(fn)) != ".pdf" {
+		w.warn(img, "", "page insertion requires a PDF file: "+img.Target.URL)
+	}
+	pages := strings.ReplaceAll(img.Attr.KeyValMap()["pages"], " ", "")
+	if pages == "" {
+		w.wr("\\copypages[" + fn + "]")
+		return
+	}
+	if !rePageSelection.MatchString(pages) {
+		w.warn(img, "", "invalid page selection '"+pages+"'")
+	}
+	w.wr("\\filterpages[" + fn + "][" + strings.ReplaceAll(pages, "-", ":") + "]")
+}
+
 // writeImage generates a ConTeXt \placefigure command for a floating figure with caption.
 // For inline images, use writeExternalFigure instead.
 func (w *Writer) writeImage(img *pandoc.Image) {
@@ -507,6 +1517,8 @@ func (w *Writer) writeImage(img *pandoc.Image) {
 		options = append(options, "none")
 	}
 
+	options = append(options, w.placementLocations(img, &img.Attr)...)
+
 	if opts := img.Attr.KeyValMap()["options"]; opts != "" {
 		options = append(options, strings.Split(opts, ",")...)
 	}
@@ -517,7 +1529,11 @@ func (w *Writer) writeImage(img *pandoc.Image) {
 	w.wr("[" + strings.Join(options, ",") + "]")
 
 	// references
-	w.wr("[" + img.Attr.Identifier + "]")
+	if img.Attr.Identifier != "" {
+		w.wr("[" + w.anchor(img.Attr.Identifier) + "]")
+	} else {
+		w.wr("[]")
+	}
 
 	// title
 	w.wr("{")
@@ -525,7 +1541,257 @@ func (w *Writer) writeImage(img *pandoc.Image) {
 	w.wr("}")
 
 	// image
+	w.fitFigure = img.Attr.KeyValMap()["placement"] == "full"
 	w.writeExternalFigure(img)
+	w.fitFigure = false
+}
+
+// figurePlacements maps the values of the placement attribute to ConTeXt float
+// locations.
+var figurePlacements = map[string]string{
+	"here":   "here",
+	"top":    "top",
+	"bottom": "bottom",
+	"page":   "page",
+	"margin": "inmargin",
+	"left":   "left",
+	"right":  "right",
+	"full":   "page",
+}
+
+// placementLocations converts the comma-separated placement attribute of a
+// figure to ConTeXt float locations. Unknown values are reported as warnings.
+func (w *Writer) placementLocations(e interface{}, attr *pandoc.Attr) []string {
+	ret := []string{}
+	s := attr.KeyValMap()["placement"]
+	if s == "" || s == "inline" {
+		return ret
+	}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if loc, ok := figurePlacements[p]; ok {
+			ret = append(ret, loc)
+		} else {
+			w.warn(e, "", "invalid placement '"+p+"': expected inline, here, top, bottom, page, margin, left, right, or full")
+		}
+	}
+	return ret
+}
+
+// subfigure is an image with its caption, placed within a figure.
+type subfigure struct {
+	img     *pandoc.Image
+	caption pandoc.InlineList
+}
+
+// collectSubfigures returns the images contained in the blocks of a figure.
+// Images nested in figures carry the caption of that figure, other images use
+// their alt text as caption.
+func collectSubfigures(bb pandoc.BlockList) []subfigure {
+	ret := []subfigure{}
+	for _, b := range bb {
+		var ll pandoc.InlineList
+		switch b := b.(type) {
+		case *pandoc.Plain:
+			ll = b.Inlines
+		case *pandoc.Para:
+			ll = b.Inlines
+		case *pandoc.Div:
+			nested := collectSubfigures(b.Blocks)
+			if b.Attr.HasClass(classFigure) && len(nested) == 1 {
+				for _, bb := range b.Blocks {
+					if d, ok := bb.(*pandoc.Div); ok && d.Attr.HasClass(classCaption) {
+						nested[0].caption = blockInlines(d.Blocks)
+					}
+				}
+			}
+			ret = append(ret, nested...)
+		}
+		for _, l := range ll {
+			if img, ok := l.(*pandoc.Image); ok {
+				ret = append(ret, subfigure{img: img, caption: img.Content})
+			}
+		}
+	}
+	return ret
+}
+
+// blockInlines returns the inlines of blocks that consist of Plain or Para
+// elements, joined with spaces.
+func blockInlines(bb pandoc.BlockList) pandoc.InlineList {
+	ret := pandoc.InlineList{}
+	for _, b := range bb {
+		var ll pandoc.InlineList
+		switch b := b.(type) {
+		case *pandoc.Plain:
+			ll = b.Inlines
+		case *pandoc.Para:
+			ll = b.Inlines
+		}
+		if len(ll) > 0 && len(ret) > 0 {
+			ret = append(ret, &pandoc.Space{})
+		}
+		ret = append(ret, ll...)
+	}
+	return ret
+}
+
+// writeFigure converts a Pandoc Figure block (see figureDiv) to a ConTeXt
+// \startplacefigure float. A single image is placed directly, multiple images are
+// placed as a combination with their own captions. A figure without images, such
+// as a table or a code block, is placed with its blocks as content.
+func (w *Writer) writeFigure(div *pandoc.Div) {
+	var caption, short pandoc.BlockList
+	content := pandoc.BlockList{}
+	for _, b := range div.Blocks {
+		if d, ok := b.(*pandoc.Div); ok && d.Attr.HasClass(classCaption) {
+			caption = d.Blocks
+		} else if ok && d.Attr.HasClass(classShortCaption) {
+			short = d.Blocks
+		} else {
+			content = append(content, b)
+		}
+	}
+	if len(content) == 0 {
+		w.warn(div, blockText(div), "figure has no content")
+		return
+	}
+	subs := collectSubfigures(content)
+	if len(subs) == 1 {
+		div = withImageAttr(div, subs[0].img)
+	}
+
+	if div.Attr.KeyValMap()["placement"] == "inline" || w.forceInline > 0 {
+		if len(subs) == 0 {
+			w.WriteBlocks(content)
+			return
+		}
+		for i, sf := range subs {
+			if i > 0 {
+				w.wr("\n")
+			}
+			w.writeExternalFigure(sf.img)
+		}
+		return
+	}
+
+	w.wr("\\startplacefigure[" + w.placeFigureOptions(div, caption, short) + "]\n")
+	w.fitFigure = div.Attr.KeyValMap()["placement"] == "full"
+	switch len(subs) {
+	case 0:
+		w.boxDepth++
+		w.WriteBlocks(content)
+		w.boxDepth--
+	case 1:
+		w.writeExternalFigure(subs[0].img)
+	default:
+		w.writeCombination(subs, fmt.Sprintf("%d*1", len(subs)))
+	}
+	w.fitFigure = false
+	w.wr("\n\\stopplacefigure")
+}
+
+// withImageAttr returns a copy of a figure div with the key-values of its image
+// added to the attributes of the div. Pandoc moves only the identifier of an
+// implicit figure to the Figure block, the other attributes stay on the image.
+func withImageAttr(div *pandoc.Div, img *pandoc.Image) *pandoc.Div {
+	attr := div.Attr
+	kv := attr.KeyValMap()
+	attr.KeyVals = append([]*pandoc.KeyVal{}, attr.KeyVals...)
+	for _, p := range img.Attr.KeyVals {
+		if _, ok := kv[p.Key]; !ok {
+			attr.KeyVals = append(attr.KeyVals, p)
+		}
+	}
+	return &pandoc.Div{Attr: attr, Blocks: div.Blocks}
+}
+
+// placeFigureOptions returns the \startplacefigure options for a div placed as
+// a figure: the reference, the location (from the placement and options
+// attributes, see withImageAttr for implicit figures), and the caption and
+// short caption.
+func (w *Writer) placeFigureOptions(div *pandoc.Div, caption, short pandoc.BlockList) string {
+	options := []string{}
+	if id := div.Attr.Identifier; id != "" {
+		options = append(options, "reference="+w.anchor(id))
+	}
+	location := []string{}
+	if len(caption) == 0 {
+		location = append(location, "none")
+	}
+	location = append(location, w.placementLocations(div, &div.Attr)...)
+	if opts := div.Attr.KeyValMap()["options"]; opts != "" {
+		location = append(location, strings.Split(opts, ",")...)
+	}
+	if len(location) > 0 {
+		options = append(options, "location={"+strings.Join(location, ",")+"}")
+	}
+	if len(caption) > 0 {
+		title := strings.TrimSpace(w.capture(func() { w.WriteBlocks(caption) }))
+		options = append(options, "title={"+title+"}")
+	}
+	if len(short) > 0 {
+		list := strings.TrimSpace(w.capture(func() { w.WriteBlocks(short) }))
+		options = append(options, "list={"+list+"}")
+	}
+	return strings.Join(options, ",")
+}
+
+// writeCombinationDiv places the images of a combination div side by side, each
+// with its alt text as caption. With combination=auto, all images are placed in
+// a single row. A div with an identifier or a caption (a trailing paragraph
+// without images) is placed as a single figure. Other blocks without images are
+// written before or after the combination, following their position in the div.
+func (w *Writer) writeCombinationDiv(div *pandoc.Div, spec string) {
+	blocks := div.Blocks
+	var caption pandoc.BlockList
+	if n := len(blocks); n > 0 {
+		if p, ok := blocks[n-1].(*pandoc.Para); ok && len(collectSubfigures(pandoc.BlockList{p})) == 0 {
+			caption = pandoc.BlockList{p}
+			blocks = blocks[:n-1]
+		}
+	}
+	var before, content, after pandoc.BlockList
+	for _, b := range blocks {
+		switch {
+		case len(collectSubfigures(pandoc.BlockList{b})) > 0:
+			content = append(content, b)
+		case len(content) == 0:
+			before = append(before, b)
+		default:
+			after = append(after, b)
+		}
+	}
+	subs := collectSubfigures(content)
+	if spec == "auto" {
+		spec = fmt.Sprintf("%d*1", len(subs))
+	}
+
+	w.WriteBlocks(before)
+	w.wr(w.blockSep)
+	if div.Attr.Identifier == "" && len(caption) == 0 {
+		w.writeCombination(subs, spec)
+	} else {
+		w.wr("\\startplacefigure[" + w.placeFigureOptions(div, caption, nil) + "]\n")
+		w.writeCombination(subs, spec)
+		w.wr("\n\\stopplacefigure")
+	}
+	w.blockSep = "\n\n"
+	w.WriteBlocks(after)
+}
+
+// writeCombination places images side by side in a ConTeXt combination, each
+// image with its caption.
+func (w *Writer) writeCombination(subs []subfigure, spec string) {
+	w.wr("\\startcombination[" + spec + "]")
+	for _, sf := range subs {
+		w.wr("\n{")
+		w.writeExternalFigure(sf.img)
+		w.wr("}{")
+		w.WriteInlines(sf.caption)
+		w.wr("}")
+	}
+	w.wr("\n\\stopcombination")
 }
 
 // FlattenInlines converts a list of inline elements to a plain string with ConTeXt escaping.
@@ -557,6 +1823,14 @@ func FlattenInlines(ll pandoc.InlineList) string {
 			buf.WriteString("}")
 		case *pandoc.RawInline:
 			buf.WriteString(l.Text)
+		case *pandoc.Span:
+			buf.WriteString(FlattenInlines(l.Content))
+		case *pandoc.Link:
+			buf.WriteString(FlattenInlines(l.Content))
+		case *pandoc.Code:
+			buf.WriteString(EscapeStr(l.Text))
+		case *pandoc.Math:
+			buf.WriteString(EscapeStr(l.Text))
 		}
 	}
 	return buf.String()
@@ -565,8 +1839,8 @@ func FlattenInlines(ll pandoc.InlineList) string {
 // WriteInlines converts a list of Pandoc inline elements to ConTeXt markup.
 // It handles text, formatting, links, images, math, and other inline elements.
 func (w *Writer) WriteInlines(ll pandoc.InlineList) {
-	for _, l := range ll {
-		switch l := l.(type) {
+	for i := 0; i < len(ll); i++ {
+		switch l := ll[i].(type) {
 		case *pandoc.Space:
 			w.wr(" ")
 
@@ -596,6 +1870,12 @@ func (w *Writer) WriteInlines(ll pandoc.InlineList) {
 			w.wr("}")
 
 		case *pandoc.Code:
+			if lang := codeLanguage(l.Attr); lang != "" && len(w.Highlight) > 0 {
+				if s, ok := highlight(l.Text, lang, w.Highlight); ok {
+					w.wr("\\mono{" + s + "}")
+					break
+				}
+			}
 			if strings.ContainsAny(l.Text, "\\~%$#{}") {
 				w.wr("\\mono{")
 				w.wr(EscapeStr(l.Text))
@@ -608,12 +1888,14 @@ func (w *Writer) WriteInlines(ll pandoc.InlineList) {
 
 		case *pandoc.Math:
 			if l.Type == "DisplayMath" {
-				w.wr("\\startformula ")
-				w.wr(l.Text)
-				w.wr(" \\stopformula")
+				id, n := equationLabel(ll[i+1:])
+				i += n
+				w.writeDisplayMath(l, l.Text, id)
 			} else {
+				m := translateMath(l.Text, false)
+				w.warnMath(l, l.Text, m)
 				w.wr("$")
-				w.wr(l.Text)
+				w.wr(m.text)
 				w.wr("$")
 			}
 
@@ -621,46 +1903,457 @@ func (w *Writer) WriteInlines(ll pandoc.InlineList) {
 			// Convert HTML break tags to ConTeXt line breaks
 			if l.Format == "html" && (l.Text == "<br>" || l.Text == "<br/>" || l.Text == "<br />") {
 				w.wr("\\crlf\n")
-			} else {
+			} else if (l.Format == "tex" || l.Format == "latex") && isMathEnvironment(l.Text) {
+				w.writeDisplayMath(l, l.Text, "")
+			} else if l.Format == "tex" || l.Format == "context" || l.Format == "latex" {
+				if env := latexEnvironment(l.Text); env != "" {
+					w.warn(l, l.Text, "unsupported LaTeX environment "+env)
+				}
 				w.wr(l.Text)
+			} else if l.Format != "html" || !isHTMLComment(l.Text) {
+				w.warn(l, l.Text, "unsupported raw inline format '"+l.Format+"'")
 			}
 
 		case *pandoc.Image:
 			kvs := l.Attr.KeyValMap()
-			if kvs["placement"] == "inline" || w.forceInline > 0 {
+			if l.Attr.HasClass("pages") {
+				w.writePages(l)
+			} else if kvs["placement"] == "inline" || w.forceInline > 0 {
 				w.writeExternalFigure(l)
 			} else {
 				w.writeImage(l)
 			}
 
+		case *pandoc.Note:
+			w.writeNote(l)
+
 		case *pandoc.Link:
-			{
-				c := FlattenInlines(l.Content)
-				if c != "" {
-					if strings.HasSuffix(c, "\\#") {
-						c = strings.TrimSuffix(c, "\\#")
-						w.wr("\\in{")
-						w.wr(EscapeStr(c))
-						w.wr("}[")
-						s := strings.TrimPrefix(l.Target.URL, "#")
-						w.wr(s)
-						w.wr(("]"))
-						break
-					}
-				}
+			w.writeLink(l)
+
+		case *pandoc.Span:
+			if l.Attr.HasClass(classCiteGroup) {
+				w.writeCitations(l.Content)
+			} else {
+				w.writeSpan(l)
+			}
+
+		default:
+			w.warn(l, "", "unsupported inline element")
+
+		}
+
+	}
+}
+
+// anchor records id as a cross-reference target and returns the identifier to
+// use in the ConTeXt output, which is namespaced for generated heading
+// identifiers. Identifiers defined more than once are reported.
+func (w *Writer) anchor(id string) string {
+	if w.anchors == nil {
+		w.anchors = map[string]bool{}
+	}
+	id = w.Document.qualify(id)
+	if w.anchors[id] {
+		w.warn(nil, "", "duplicate identifier '"+id+"'")
+	}
+	w.anchors[id] = true
+	return id
+}
+
+// ref records id as a cross-reference to a target that must exist in one of the
+// markdown assets, and returns the identifier to use in the ConTeXt output.
+// References to generated heading identifiers of the current document are
+// namespaced like their targets.
+func (w *Writer) ref(id string) string {
+	id = w.resolve(id)
+	w.refs = append(w.refs, id)
+	return id
+}
+
+// resolve returns the output identifier for a reference to id. Identifiers of
+// the current document are namespaced like their targets. Other identifiers
+// resolve to explicit heading identifiers, or to generated heading identifiers
+// of other markdown assets, so that # links between assets keep working.
+func (w *Writer) resolve(id string) string {
+	d := w.Document
+	if d == nil || d.Namespace == "" || d.generated[id] || d.explicit[id] {
+		return d.qualify(id)
+	}
+	fns := []string{}
+	for fn, other := range w.Documents {
+		if other.explicit[id] {
+			return id
+		}
+		if other.generated[id] {
+			fns = append(fns, fn)
+		}
+	}
+	if len(fns) == 0 {
+		return id
+	}
+	sort.Strings(fns)
+	qualified := w.Documents[fns[0]].qualify(id)
+	if len(fns) > 1 {
+		w.warn(nil, "", "ambiguous reference to '"+id+"', resolved to '"+qualified+"'")
+	}
+	return qualified
+}
+
+// equationLabel detects a pandoc-crossref style equation label ({#eq:id}) that
+// follows display math. It returns the label and the number of inlines it spans.
+func equationLabel(ll pandoc.InlineList) (string, int) {
+	for i, l := range ll {
+		switch l := l.(type) {
+		case *pandoc.Space, *pandoc.SoftBreak:
+			continue
+		case *pandoc.Str:
+			if strings.HasPrefix(l.Text, "{#") && strings.HasSuffix(l.Text, "}") {
+				return l.Text[2 : len(l.Text)-1], i + 1
+			}
+		}
+		break
+	}
+	return "", 0
+}
+
+// writeDisplayMath translates LaTeX display math and writes it as a ConTeXt
+// formula. Formulas with an identifier (from the markdown label or from \label)
+// or a \tag are placed with \placeformula.
+func (w *Writer) writeDisplayMath(e interface{}, tex string, id string) {
+	m := translateMath(tex, true)
+	w.warnMath(e, tex, m)
+	if id == "" {
+		id = m.label
+	}
+	if id != "" || m.tag != "" {
+		w.wr("\\placeformula")
+		if id != "" {
+			w.wr("[" + w.anchor(id) + "]")
+		}
+		if m.tag != "" {
+			w.wr("{" + m.tag + "}")
+		}
+	}
+	w.wr("\\startformula ")
+	w.wr(m.text)
+	w.wr(" \\stopformula")
+}
+
+// warnMath records the problems found while translating math.
+func (w *Writer) warnMath(e interface{}, tex string, m mathTranslation) {
+	for _, p := range m.problems {
+		w.warn(e, tex, "untranslated math: "+p)
+	}
+}
+
+// defaultRefPrefixes lists the texts written before the numbers of
+// pandoc-crossref style references.
+var defaultRefPrefixes = map[string]string{
+	"fig": "Figure",
+	"tbl": "Table",
+	"sec": "Section",
+	"eq":  "Equation",
+	"lst": "Listing",
+}
+
+// crossrefKind returns the pandoc-crossref prefix (fig, tbl, sec, eq, lst) of a
+// citation identifier, or an empty string for bibliographic citations.
+func crossrefKind(id string) string {
+	if i := strings.IndexByte(id, ':'); i > 0 {
+		if _, ok := defaultRefPrefixes[id[:i]]; ok {
+			return id[:i]
+		}
+	}
+	return ""
+}
+
+// writeCrossrefs converts pandoc-crossref style citations (@fig:id, @tbl:id,
+// @sec:id, @eq:id, @lst:id) to ConTeXt \in references. Suppress-author
+// citations (-@fig:id) produce the number only.
+func (w *Writer) writeCrossrefs(cc []*pandoc.Cite) {
+	for i, c := range cc {
+		if i > 0 {
+			w.wr(", ")
+		}
+		if len(c.Prefix) > 0 {
+			w.WriteInlines(c.Prefix)
+			w.wr(" ")
+		}
+		w.wr("\\in")
+		if c.Mode != "SuppressAuthor" {
+			kind := crossrefKind(c.Id)
+			prefix, ok := w.RefPrefixes[kind]
+			if !ok {
+				prefix = defaultRefPrefixes[kind]
+			}
+			w.wr("{" + prefix + "}")
+		}
+		w.wr("[" + w.ref(c.Id) + "]")
+		w.WriteInlines(c.Suffix)
+	}
+}
+
+// writeLink converts a Pandoc link to ConTeXt markup. Links to fragments with a
+// ref, pageref, or nameref class (or with empty text) become \in, \at, or
+// \about references, links whose text ends with # become \in references
+// with the text as a prefix, and other # links become \goto links to the
+// identifier. External links become \goto hyperlinks with an escaped URL, and
+// autolinks display the URL with \hyphenatedurl. Links to other markdown
+// assets are converted to links to their headings.
+func (w *Writer) writeLink(l *pandoc.Link) {
+	if u, ok := w.documentLink(l); ok {
+		l = &pandoc.Link{Attr: l.Attr, Content: l.Content, Target: pandoc.Target{URL: u, Title: l.Target.Title}}
+	}
 
-				w.wr("\\goto{")
+	if strings.HasPrefix(l.Target.URL, "#") {
+		id := l.Target.URL[1:]
+		cmd := ""
+		switch {
+		case l.Attr.HasClass("ref"):
+			cmd = "\\in"
+		case l.Attr.HasClass("pageref"):
+			cmd = "\\at"
+		case l.Attr.HasClass("nameref"):
+			w.wr("\\about[" + w.ref(id) + "]")
+			return
+		case len(l.Content) == 0:
+			cmd = "\\in"
+		}
+		if cmd != "" {
+			w.wr(cmd)
+			if len(l.Content) > 0 {
+				w.wr("{")
 				w.WriteInlines(l.Content)
-				w.wr("}[url(")
-				s := strings.TrimPrefix(l.Target.URL, "#")
-				w.wr(s)
-				w.wr((")]"))
+				w.wr("}")
 			}
+			w.wr("[" + w.ref(id) + "]")
+			return
+		}
+	}
 
-			// todo Link, Cite, Span
+	c := FlattenInlines(l.Content)
+	if strings.HasSuffix(c, "\\#") {
+		c = strings.TrimSuffix(c, "\\#")
+		w.wr("\\in{")
+		w.wr(c)
+		w.wr("}[")
+		w.wr(w.ref(strings.TrimPrefix(l.Target.URL, "#")))
+		w.wr("]")
+		return
+	}
 
+	if strings.HasPrefix(l.Target.URL, "#") {
+		w.wr("\\goto{")
+		w.WriteInlines(l.Content)
+		w.wr("}[" + w.ref(l.Target.URL[1:]) + "]")
+		return
+	}
+
+	w.wr("\\goto{")
+	if text := plainText(l.Content); isAutolink(l, text) {
+		w.wr("\\hyphenatedurl{" + letterEscaper.Replace(strings.TrimPrefix(text, "mailto:")) + "}")
+	} else {
+		w.WriteInlines(l.Content)
+	}
+	w.wr("}[url(" + urlEscaper.Replace(l.Target.URL) + ")]")
+}
+
+// documentLink resolves a relative link to another markdown asset, such as
+// install.md#prerequisites, to a # link to the target heading, or to the first
+// heading of the asset when there is no fragment. Links to markdown files that
+// are not part of the build are reported and left unchanged.
+func (w *Writer) documentLink(l *pandoc.Link) (string, bool) {
+	u, err := url.Parse(l.Target.URL)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	switch strings.ToLower(filepath.Ext(u.Path)) {
+	case ".md", ".markdown":
+	default:
+		return "", false
+	}
+	fn, err := normalizePath(w.indir, filepath.FromSlash(u.Path))
+	if err != nil {
+		return "", false
+	}
+	d, ok := w.Documents[fn]
+	if !ok {
+		w.warn(l, plainText(l.Content), "linked document is not part of the build: "+l.Target.URL)
+		return "", false
+	}
+	if u.Fragment != "" {
+		return "#" + d.qualify(u.Fragment), true
+	}
+	if d.FirstHeading == "" {
+		w.warn(l, plainText(l.Content), "linked document has no heading to refer to: "+l.Target.URL)
+		return "", false
+	}
+	return "#" + d.qualify(d.FirstHeading), true
+}
+
+// isAutolink reports whether a link displays its own target, as in <https://...>
+// autolinks and bare e-mail addresses.
+func isAutolink(l *pandoc.Link, text string) bool {
+	if l.Attr.HasClass("uri") || l.Attr.HasClass("email") {
+		return true
+	}
+	return text != "" && (text == l.Target.URL || "mailto:"+text == l.Target.URL)
+}
+
+// letterEscaper escapes TeX special characters with the \letter... commands,
+// which typeset the characters themselves. It is used for URLs displayed with
+// \hyphenatedurl and for highlighted code, where \~ would be an accent.
+var letterEscaper = strings.NewReplacer(
+	`\`, `\letterbackslash `,
+	`#`, `\letterhash `,
+	`%`, `\letterpercent `,
+	`&`, `\letterampersand `,
+	`~`, `\lettertilde `,
+	`$`, `\letterdollar `,
+	`{`, `\letterleftbrace `,
+	`}`, `\letterrightbrace `,
+)
+
+// urlEscaper escapes a URL for use in [url(...)] references. In addition to the
+// TeX special characters, the characters that end the reference are
+// percent-encoded.
+var urlEscaper = strings.NewReplacer(
+	`\`, `\letterbackslash `,
+	`#`, `\letterhash `,
+	`%`, `\letterpercent `,
+	`&`, `\letterampersand `,
+	`~`, `\lettertilde `,
+	`$`, `\letterdollar `,
+	`{`, `\letterleftbrace `,
+	`}`, `\letterrightbrace `,
+	`(`, `\letterpercent 28`,
+	`)`, `\letterpercent 29`,
+	`[`, `\letterpercent 5B`,
+	`]`, `\letterpercent 5D`,
+	` `, `\letterpercent 20`,
+)
+
+// spanCommands returns the opening and closing markup for a span class. Classes
+// mapped in SpanStyles take precedence over the built-in classes.
+func (w *Writer) spanCommands(class string) (open string, close string) {
+	if st, ok := w.SpanStyles[class]; ok {
+		return styleCommands(st)
+	}
+	switch class {
+	case "mark", "highlight":
+		return "\\highlight[mark]{", "}"
+	case "underline":
+		return "\\underbar{", "}"
+	case "smallcaps":
+		return "{\\sc ", "}"
+	case "nowrap":
+		return "\\hbox{", "}"
+	}
+	return "", ""
+}
+
+// writeSpan converts a Pandoc span to ConTeXt markup. Span classes are mapped to
+// styles with spanCommands, and color and style attributes are mapped to \color
+// and \style. A span identifier becomes a \reference (or a \pagereference for
+// empty spans) that can be used as a link target.
+func (w *Writer) writeSpan(span *pandoc.Span) {
+	if id := span.Attr.Identifier; id != "" {
+		if len(span.Content) == 0 {
+			w.wr("\\pagereference[" + w.anchor(id) + "]")
+		} else {
+			w.wr("\\reference[" + w.anchor(id) + "]{" + FlattenInlines(span.Content) + "}")
 		}
+	}
 
+	closing := ""
+	for _, c := range span.Attr.Classes {
+		open, close := w.spanCommands(c)
+		w.wr(open)
+		closing = close + closing
+	}
+	kv := span.Attr.KeyValMap()
+	if s := kv["style"]; s != "" {
+		w.wr("\\style[" + s + "]{")
+		closing = "}" + closing
+	}
+	if c := kv["color"]; c != "" {
+		w.wr("\\color[" + c + "]{")
+		closing = "}" + closing
+	}
+	w.WriteInlines(span.Content)
+	w.wr(closing)
+}
+
+// citeAlternative maps a Pandoc citation mode to a ConTeXt \cite alternative.
+// Normal citations use the alternative configured with \setupbtx.
+func citeAlternative(mode string) string {
+	switch mode {
+	case "AuthorInText":
+		return "authoryear"
+	case "SuppressAuthor":
+		return "year"
+	default:
+		return ""
+	}
+}
+
+// writeCitations converts a group of Pandoc citations to ConTeXt \cite commands.
+// Citations that share a mode and have no prefix or suffix are combined into a
+// single \cite; otherwise, each citation is written separately with its prefix
+// and suffix (including locators) passed as lefttext and righttext.
+func (w *Writer) writeCitations(ll pandoc.InlineList) {
+	cc := []*pandoc.Cite{}
+	for _, l := range ll {
+		if c, ok := l.(*pandoc.Cite); ok {
+			cc = append(cc, c)
+		}
+	}
+	if len(cc) == 0 {
+		return
+	}
+	if crossrefKind(cc[0].Id) != "" {
+		w.writeCrossrefs(cc)
+		return
+	}
+
+	simple := true
+	for _, c := range cc {
+		if len(c.Prefix) > 0 || len(c.Suffix) > 0 || c.Mode != cc[0].Mode {
+			simple = false
+		}
+	}
+	if simple {
+		keys := []string{}
+		for _, c := range cc {
+			keys = append(keys, c.Id)
+		}
+		w.wr("\\cite")
+		if alt := citeAlternative(cc[0].Mode); alt != "" {
+			w.wr("[" + alt + "]")
+		}
+		w.wr("[" + strings.Join(keys, ",") + "]")
+		return
+	}
+
+	for i, c := range cc {
+		if i > 0 {
+			w.wr("; ")
+		}
+		opts := []string{}
+		if alt := citeAlternative(c.Mode); alt != "" {
+			opts = append(opts, "alternative="+alt)
+		}
+		if len(c.Prefix) > 0 {
+			opts = append(opts, "lefttext={"+w.capture(func() { w.WriteInlines(c.Prefix) })+" }")
+		}
+		if len(c.Suffix) > 0 {
+			opts = append(opts, "righttext={"+w.capture(func() { w.WriteInlines(c.Suffix) })+"}")
+		}
+		w.wr("\\cite")
+		if len(opts) > 0 {
+			w.wr("[" + strings.Join(opts, ",") + "]")
+		}
+		w.wr("[" + c.Id + "]")
 	}
 }
 
@@ -708,19 +2401,78 @@ func contextFmt(f pandoc.InlineFmt) string {
 }
 
 // splitNumUnits parses a size string into a numeric value and unit.
-// Supported units are %, px, cm, mm, in, inch, pt, and em.
-func splitNumUnits(s string) (n float32, u string, err error) {
-	for _, p := range []string{"%", "px", "cm", "mm", "in", "inch", "pt", "em"} {
+// Supported units are %, px, cm, mm, in, inch, pt, bp, pc, em, and ex. Numbers
+// without a unit are pixels, as in Pandoc.
+func splitNumUnits(s string) (n float64, u string, err error) {
+	s = strings.TrimSpace(s)
+	for _, p := range []string{"%", "px", "cm", "mm", "inch", "in", "pt", "bp", "pc", "em", "ex"} {
 		if strings.HasSuffix(s, p) {
 			u = p
-			s = s[:len(s)-len(p)]
+			s = strings.TrimSpace(s[:len(s)-len(p)])
 			break
 		}
 	}
-	v, err := strconv.ParseFloat(s, 32)
+	n, err = strconv.ParseFloat(s, 64)
 	if err != nil {
-		return 0, "", err
+		return 0, "", fmt.Errorf("invalid number '%s'", s)
 	}
-	n = float32(v)
-	return
+	if n < 0 {
+		return 0, "", fmt.Errorf("negative size")
+	}
+	if u == "" {
+		u = "px"
+	}
+	return n, u, nil
+}
+
+// formatNum formats a number with at most four decimals.
+func formatNum(n float64) string {
+	return strconv.FormatFloat(math.Round(n*10000)/10000, 'f', -1, 64)
+}
+
+// imageDimension converts a Pandoc image size to a ConTeXt dimension. Pixels
+// are converted with ImageDPI. Percentages of the width are relative to the
+// enclosing container (\hsize within tables, columns and other boxes, otherwise
+// \textwidth), percentages of the height are relative to \textheight.
+func (w *Writer) imageDimension(s string, horizontal bool) (string, error) {
+	n, u, err := splitNumUnits(s)
+	if err != nil {
+		return "", err
+	}
+	switch u {
+	case "%":
+		ref := "\\textheight"
+		if horizontal {
+			ref = "\\textwidth"
+			if w.tableDepth > 0 || w.boxDepth > 0 {
+				ref = "\\hsize"
+			}
+		}
+		return formatNum(n/100) + ref, nil
+	case "px":
+		if w.ImageDPI <= 0 {
+			return "", fmt.Errorf("invalid DPI %g", w.ImageDPI)
+		}
+		return formatNum(n/w.ImageDPI) + "in", nil
+	case "inch":
+		return formatNum(n) + "in", nil
+	default:
+		return formatNum(n) + u, nil
+	}
+}
+
+// imageScale converts a scale attribute, either a factor (0.5) or a percentage
+// (50%), to the ConTeXt scale, where 1000 is the natural size.
+func imageScale(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	f := 1.0
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		f = 0.01
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid scale '%s'", s)
+	}
+	return strconv.Itoa(int(math.Round(n * f * 1000))), nil
 }
@@ -0,0 +1,927 @@
+package context
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/adnsv/go-pandoc"
+)
+
+// pandocJSON wraps blocks in a pandoc 3 JSON document.
+func pandocJSON(blocks string) string {
+	return `{"pandoc-api-version":[1,23,1],"meta":{},"blocks":[` + blocks + `]}`
+}
+
+// convert loads a pandoc JSON document the way LoadMain does and writes it as
+// ConTeXt. The options set up the writer before the blocks are written.
+func convert(t *testing.T, jbuf string, options ...func(w *Writer)) (string, *Writer) {
+	t.Helper()
+	d, err := loadDocument([]byte(jbuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow, err := d.Flow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	w := NewWriter(&out, t.TempDir())
+	for _, opt := range options {
+		opt(w)
+	}
+	w.WriteBlocks(flow)
+	w.Flush()
+	return out.String(), w
+}
+
+// header returns the pandoc JSON of a heading with the given level and text.
+func header(level int, text string) string {
+	return `{"t":"Header","c":[` + strconv.Itoa(level) + `,["",[],[]],[{"t":"Str","c":"` + text + `"}]]}`
+}
+
+// implicitFigure returns the pandoc 3 JSON of ![c](x.png){#id key=value...}:
+// the identifier is on the Figure block, the key-values stay on the image.
+func implicitFigure(id string, kvs string) string {
+	return `{"t":"Figure","c":[["` + id + `",[],[]],[null,[{"t":"Plain","c":[{"t":"Str","c":"c"}]}]],` +
+		`[{"t":"Plain","c":[{"t":"Image","c":[["",[],[` + kvs + `]],[{"t":"Str","c":"c"}],["x.png",""]]}]}]]}`
+}
+
+func TestImplicitFigureAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		kvs      string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:     "inline",
+			kvs:      `["placement","inline"]`,
+			want:     []string{`\externalfigure[`},
+			dontWant: []string{`\startplacefigure`},
+		},
+		{
+			name: "full",
+			kvs:  `["placement","full"]`,
+			want: []string{`location={page}`, `factor=fit`},
+		},
+		{
+			name: "options",
+			kvs:  `["options","force"]`,
+			want: []string{`location={force}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := convert(t, pandocJSON(implicitFigure("fig:a", tt.kvs)))
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("output does not contain %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.dontWant {
+				if strings.Contains(out, s) {
+					t.Errorf("output contains %q:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestImplicitFigurePlacement(t *testing.T) {
+	tests := []struct {
+		placement string
+		location  string
+	}{
+		{"here", "location={here}"},
+		{"top", "location={top}"},
+		{"bottom", "location={bottom}"},
+		{"page", "location={page}"},
+		{"margin", "location={inmargin}"},
+		{"top,page", "location={top,page}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.placement, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(implicitFigure("fig:a", `["placement","`+tt.placement+`"]`)))
+			want := `\startplacefigure[reference=fig:a,` + tt.location + `,title={c}]`
+			if !strings.Contains(out, want) {
+				t.Errorf("output does not contain %q:\n%s", want, out)
+			}
+			for _, wrn := range w.Warnings {
+				if strings.Contains(wrn.Message, "placement") {
+					t.Errorf("unexpected warning: %s", wrn)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadingTitlesRecordedOnce(t *testing.T) {
+	heading := `{"t":"Header","c":[1,["h",[],[]],[` +
+		`{"t":"Math","c":[{"t":"InlineMath"},"x \\tag{1}"]},{"t":"Space"},` +
+		`{"t":"Span","c":[["s",[],[]],[{"t":"Str","c":"span"}]]},` +
+		`{"t":"Note","c":[{"t":"Para","c":[{"t":"Str","c":"note"}]}]}]]}`
+	out, w := convert(t, pandocJSON(heading))
+	if !strings.Contains(out, "list={") {
+		t.Errorf("output has no list title:\n%s", out)
+	}
+	if len(w.Warnings) != 1 {
+		t.Errorf("got %d warnings, want 1: %v", len(w.Warnings), w.Warnings)
+	}
+	if strings.Count(out, `\reference[s]`) != 1 {
+		t.Errorf("span reference is not written once:\n%s", out)
+	}
+}
+
+func TestSectionsContinueAcrossAssets(t *testing.T) {
+	first, w := convert(t, pandocJSON(header(1, "One")+","+header(2, "A")), func(w *Writer) {
+		w.KeepSections = true
+	})
+	second, _ := convert(t, pandocJSON(header(2, "B")), func(next *Writer) {
+		next.continueSections(w)
+	})
+	if strings.Contains(first, `\stop`) {
+		t.Errorf("first asset stops its sections:\n%s", first)
+	}
+	want := "\\stopsection\n\n\\startsection[title={B}]\n\n\\stopsection\n\n\\stopchapter"
+	if second != want {
+		t.Errorf("second asset:\n%s\nwant:\n%s", second, want)
+	}
+}
+
+func TestLongTableHeadRecordedOnce(t *testing.T) {
+	cell := func(inlines string) string {
+		return `[["",[],[]],{"t":"AlignDefault"},1,1,[{"t":"Plain","c":[` + inlines + `]}]]`
+	}
+	row := func(inlines string) string {
+		return `[["",[],[]],[` + cell(inlines) + `]]`
+	}
+	table := `{"t":"Table","c":[["",["long"],[]],[null,[]],[[{"t":"AlignDefault"},{"t":"ColWidthDefault"}]],` +
+		`[["",[],[]],[` + row(`{"t":"Span","c":[["h",[],[]],[{"t":"Str","c":"Head"}]]},`+
+		`{"t":"Note","c":[{"t":"Para","c":[{"t":"Str","c":"note"}]}]}`) + `]],` +
+		`[[["",[],[]],0,[],[` + row(`{"t":"Str","c":"body"}`) + `]]],` +
+		`[["",[],[]],[]]]}`
+	out, w := convert(t, pandocJSON(table))
+	if !strings.Contains(out, `\startxtablenext`) {
+		t.Fatalf("table is not split:\n%s", out)
+	}
+	if n := strings.Count(out, `\footnotetext`); n != 1 {
+		t.Errorf("got %d note texts, want 1:\n%s", n, out)
+	}
+	if len(w.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", w.Warnings)
+	}
+}
+
+func TestCombinationDivBlocks(t *testing.T) {
+	para := func(text string) string {
+		return `{"t":"Para","c":[{"t":"Str","c":"` + text + `"}]}`
+	}
+	list := `{"t":"BulletList","c":[[{"t":"Plain","c":[{"t":"Str","c":"Item"}]}]]}`
+	div := `{"t":"Div","c":[["fig:v",[],[["combination","auto"]]],[` +
+		para("Intro") + "," + implicitFigure("", "") + "," + implicitFigure("", "") + "," +
+		list + "," + para("Views") + `]]}`
+	out, _ := convert(t, pandocJSON(div))
+
+	order := []string{"Intro", `\startplacefigure[reference=fig:v,title={Views}]`,
+		`\startcombination[2*1]`, `\stopplacefigure`, "Item"}
+	pos := 0
+	for _, s := range order {
+		i := strings.Index(out[pos:], s)
+		if i < 0 {
+			t.Fatalf("output does not contain %q after position %d:\n%s", s, pos, out)
+		}
+		pos += i + len(s)
+	}
+}
+
+func TestParseLineRanges(t *testing.T) {
+	tests := []struct {
+		s     string
+		lines int
+		want  []int
+		err   bool
+	}{
+		{"2", 5, []int{2}, false},
+		{"1-3, 5", 5, []int{1, 2, 3, 5}, false},
+		{"4-1000000000", 5, []int{4, 5}, false},
+		{"9", 5, nil, false},
+		{"3-1", 5, nil, true},
+		{"x", 5, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLineRanges(tt.s, tt.lines)
+		if (err != nil) != tt.err {
+			t.Errorf("parseLineRanges(%q) error = %v", tt.s, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseLineRanges(%q) = %v, want %v", tt.s, got, tt.want)
+			continue
+		}
+		for _, n := range tt.want {
+			if !got[n] {
+				t.Errorf("parseLineRanges(%q) = %v, want %v", tt.s, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseAttr(t *testing.T) {
+	tests := []struct {
+		s    string
+		want pandoc.Attr
+		ok   bool
+	}{
+		{"#tbl:a", pandoc.Attr{Identifier: "tbl:a"}, true},
+		{"#tbl:a .long split=yes", pandoc.Attr{Identifier: "tbl:a", Classes: []string{"long"},
+			KeyVals: []*pandoc.KeyVal{{Key: "split", Val: "yes"}}}, true},
+		{`notes="See the appendix."`, pandoc.Attr{KeyVals: []*pandoc.KeyVal{{Key: "notes", Val: "See the appendix."}}}, true},
+		{"plain text", pandoc.Attr{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseAttr(tt.s)
+		if ok != tt.ok {
+			t.Errorf("parseAttr(%q) ok = %v, want %v", tt.s, ok, tt.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAttr(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUnnumberedPart(t *testing.T) {
+	heading := `{"t":"Header","c":[1,["",["unnumbered"],[]],[{"t":"Str","c":"Preface"}]]}`
+	out, _ := convert(t, pandocJSON(heading), func(w *Writer) { w.SetTopLevelDivision("part") })
+	want := "\\definehead[unnumberedpart][part][number=no,incrementnumber=no]\n" +
+		"\\startunnumberedpart[title={Preface}]\n\n\\stopunnumberedpart"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+
+	if got := (Heading{Command: "part"}).unnumbered(); got != unnumberedPart {
+		t.Errorf("unnumbered part heading = %q", got)
+	}
+}
+
+func TestHeadingLevel(t *testing.T) {
+	tests := map[string]int{
+		"part": 1, "unnumberedpart": 1, "chapter": 2, "title": 2, "section": 3, "subject": 3,
+		"subsection": 4, "subsubsubject": 5, "mysection": 0, "appendix": 0,
+	}
+	for name, want := range tests {
+		if got := headingLevel(name); got != want {
+			t.Errorf("headingLevel(%q) = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestEndnotesPerChapter(t *testing.T) {
+	note := `{"t":"Para","c":[{"t":"Str","c":"text"},{"t":"Note","c":[{"t":"Para","c":[{"t":"Str","c":"note"}]}]}]}`
+	s, _ := convert(t, pandocJSON(header(1, "Part")+","+header(2, "One")+","+note+","+
+		header(3, "Section")+","+header(2, "Two")), func(w *Writer) {
+		w.SetTopLevelDivision("part")
+		w.Endnotes = true
+	})
+	notes := strings.Index(s, `\placenotes[endnote]`)
+	if notes < 0 || notes > strings.Index(s, `title={Two}`) || notes < strings.Index(s, `title={Section}`) {
+		t.Errorf("endnotes are not placed before the second chapter:\n%s", s)
+	}
+}
+
+func TestFigureWithoutImages(t *testing.T) {
+	para := `{"t":"Para","c":[{"t":"Str","c":"text"}]}`
+	caption := `[null,[{"t":"Plain","c":[{"t":"Str","c":"c"}]}]]`
+	tests := []struct {
+		name     string
+		figure   string
+		want     string
+		warnings int
+	}{
+		{
+			name:   "para",
+			figure: `{"t":"Figure","c":[["fig:a",[],[]],` + caption + `,[` + para + `]]}`,
+			want:   "\\startplacefigure[reference=fig:a,title={c}]\ntext\n\\stopplacefigure",
+		},
+		{
+			name:   "inline",
+			figure: `{"t":"Figure","c":[["",[],[["placement","inline"]]],` + caption + `,[` + para + `]]}`,
+			want:   "text",
+		},
+		{
+			name:     "empty",
+			figure:   `{"t":"Figure","c":[["",[],[]],` + caption + `,[]]}`,
+			want:     "",
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(tt.figure))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
+
+func TestAppendices(t *testing.T) {
+	header := func(level, class, text string) string {
+		return `{"t":"Header","c":[` + level + `,["",[` + class + `],[]],[{"t":"Str","c":"` + text + `"}]]}`
+	}
+	tests := []struct {
+		name     string
+		blocks   string
+		want     string
+		warnings int
+	}{
+		{
+			name:   "top",
+			blocks: header("1", "", "One") + "," + header("1", `"appendix"`, "A") + "," + header("2", "", "B"),
+			want: "\\startchapter[title={One}]\n\n\\stopchapter\n\n\\startappendices\n\n\\startchapter[title={A}]\n\n" +
+				"\\startsection[title={B}]\n\n\\stopsection\n\n\\stopchapter\n\n\\stopappendices",
+		},
+		{
+			name:     "nested",
+			blocks:   header("1", "", "One") + "," + header("2", `"appendix"`, "A"),
+			want:     "\\startchapter[title={One}]\n\n\\startsection[title={A}]\n\n\\stopsection\n\n\\stopchapter",
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(tt.blocks))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
+
+func TestListingFloatDefinedOnce(t *testing.T) {
+	code := func(id string) string {
+		return `{"t":"CodeBlock","c":[["` + id + `",[],[["caption","Code"]]],"x"]}`
+	}
+	out, _ := convert(t, pandocJSON(code("lst:a")+","+code("lst:b")))
+	want := "\\definefloat[listing][listings]\n\\startplacelisting[reference=lst:a,title={Code}]\n"
+	if !strings.HasPrefix(out, want) {
+		t.Errorf("output does not start with %q:\n%s", want, out)
+	}
+	if n := strings.Count(out, `\definefloat`); n != 1 {
+		t.Errorf("listing float is defined %d times:\n%s", n, out)
+	}
+}
+
+func TestRawHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   string
+		want     string
+		warnings int
+	}{
+		{
+			name:   "comment block",
+			blocks: `{"t":"RawBlock","c":["html","<!-- note -->\n"]}`,
+		},
+		{
+			name:   "comment inline",
+			blocks: `{"t":"Para","c":[{"t":"Str","c":"a"},{"t":"RawInline","c":["html","<!-- x -->"]}]}`,
+			want:   "a",
+		},
+		{
+			name:   "break",
+			blocks: `{"t":"Para","c":[{"t":"Str","c":"a"},{"t":"RawInline","c":["html","<br>"]},{"t":"Str","c":"b"}]}`,
+			want:   "a\\crlf\nb",
+		},
+		{
+			name:     "element",
+			blocks:   `{"t":"Para","c":[{"t":"RawInline","c":["html","<b>"]},{"t":"Str","c":"a"}]}`,
+			want:     "a",
+			warnings: 1,
+		},
+		{
+			name:     "block",
+			blocks:   `{"t":"RawBlock","c":["html","<div>"]}`,
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(tt.blocks))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
+
+// paraJSON returns the pandoc JSON of a paragraph with the given inlines.
+func paraJSON(inlines string) string {
+	return `{"t":"Para","c":[` + inlines + `]}`
+}
+
+func TestCitations(t *testing.T) {
+	citation := func(id, mode, prefix, suffix string) string {
+		return `{"citationId":"` + id + `","citationPrefix":[` + prefix + `],"citationSuffix":[` + suffix + `],` +
+			`"citationMode":{"t":"` + mode + `"},"citationNoteNum":1,"citationHash":0}`
+	}
+	cite := func(citations ...string) string {
+		return `{"t":"Cite","c":[[` + strings.Join(citations, ",") + `],[{"t":"Str","c":"[@x]"}]]}`
+	}
+	tests := []struct {
+		name string
+		cite string
+		want string
+	}{
+		{
+			name: "plain",
+			cite: cite(citation("knuth", "NormalCitation", "", "")),
+			want: `\cite[knuth]`,
+		},
+		{
+			name: "in text",
+			cite: cite(citation("knuth", "AuthorInText", "", "")),
+			want: `\cite[authoryear][knuth]`,
+		},
+		{
+			name: "suppress author",
+			cite: cite(citation("knuth", "SuppressAuthor", "", "")),
+			want: `\cite[year][knuth]`,
+		},
+		{
+			name: "grouped",
+			cite: cite(citation("knuth", "NormalCitation", "", ""), citation("lamport", "NormalCitation", "", "")),
+			want: `\cite[knuth,lamport]`,
+		},
+		{
+			name: "prefix and suffix",
+			cite: cite(citation("knuth", "NormalCitation", `{"t":"Str","c":"see"}`, `{"t":"Str","c":","},{"t":"Space"},{"t":"Str","c":"p. 12"}`),
+				citation("lamport", "NormalCitation", "", "")),
+			want: `\cite[lefttext={see },righttext={, p. 12}][knuth]; \cite[lamport]`,
+		},
+		{
+			name: "crossref",
+			cite: cite(citation("fig:a", "NormalCitation", "", ""), citation("tbl:b", "SuppressAuthor", "", "")),
+			want: `\in{Figure}[fig:a], \in[tbl:b]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := convert(t, pandocJSON(paraJSON(tt.cite)))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpans(t *testing.T) {
+	span := func(id, classes, kvs string) string {
+		return `{"t":"Span","c":[["` + id + `",[` + classes + `],[` + kvs + `]],[{"t":"Str","c":"text"}]]}`
+	}
+	term := SpanStyle{Style: "italic", Color: "blue"}
+	tests := []struct {
+		name   string
+		span   string
+		styles map[string]SpanStyle
+		want   string
+	}{
+		{"mark", span("", `"mark"`, ""), nil, `\highlight[mark]{text}`},
+		{"underline", span("", `"underline"`, ""), nil, `\underbar{text}`},
+		{"smallcaps", span("", `"smallcaps"`, ""), nil, `{\sc text}`},
+		{"nowrap", span("", `"nowrap"`, ""), nil, `\hbox{text}`},
+		{"unknown", span("", `"other"`, ""), nil, `text`},
+		{"template", span("", `"term"`, ""), map[string]SpanStyle{"term": term}, `\style[italic]{\color[blue]{text}}`},
+		{"template overrides", span("", `"mark"`, ""), map[string]SpanStyle{"mark": term}, `\style[italic]{\color[blue]{text}}`},
+		{"nested classes", span("", `"underline","smallcaps"`, ""), nil, `\underbar{{\sc text}}`},
+		{"attributes", span("", "", `["style","bold"],["color","red"]`), nil, `\style[bold]{\color[red]{text}}`},
+		{"identifier", span("s", "", ""), nil, `\reference[s]{text}text`},
+		{"empty", `{"t":"Span","c":[["s",[],[]],[]]}`, nil, `\pagereference[s]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := convert(t, pandocJSON(paraJSON(tt.span)), func(w *Writer) { w.SpanStyles = tt.styles })
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestInternalLinks(t *testing.T) {
+	link := func(class, text, url string) string {
+		content := ""
+		if text != "" {
+			content = `{"t":"Str","c":"` + text + `"}`
+		}
+		return `{"t":"Link","c":[["",[` + class + `],[]],[` + content + `],["` + url + `",""]]}`
+	}
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"ref", link(`"ref"`, "Figure", "#fig:a"), `\in{Figure}[fig:a]`},
+		{"ref without text", link(`"ref"`, "", "#fig:a"), `\in[fig:a]`},
+		{"pageref", link(`"pageref"`, "page", "#fig:a"), `\at{page}[fig:a]`},
+		{"nameref", link(`"nameref"`, "ignored", "#sec:a"), `\about[sec:a]`},
+		{"empty text", link("", "", "#fig:a"), `\in[fig:a]`},
+		{"number suffix", link("", "Figure #", "#fig:a"), `\in{Figure }[fig:a]`},
+		{"goto", link("", "see", "#fig:a"), `\goto{see}[fig:a]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(paraJSON(tt.link)))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+			if len(w.refs) != 1 {
+				t.Errorf("got references %v, want one", w.refs)
+			}
+		})
+	}
+}
+
+func TestTableCells(t *testing.T) {
+	cell := func(align string, rows, cols int, text string) string {
+		return `[["",[],[]],{"t":"` + align + `"},` + strconv.Itoa(rows) + `,` + strconv.Itoa(cols) +
+			`,[{"t":"Plain","c":[{"t":"Str","c":"` + text + `"}]}]]`
+	}
+	row := func(cells ...string) string {
+		return `[["",[],[]],[` + strings.Join(cells, ",") + `]]`
+	}
+	table := func(specs string, rows ...string) string {
+		return `{"t":"Table","c":[["",[],[]],[null,[]],[` + specs + `],[["",[],[]],[]],` +
+			`[[["",[],[]],0,[],[` + strings.Join(rows, ",") + `]]],[["",[],[]],[]]]}`
+	}
+	tests := []struct {
+		name  string
+		table string
+		cells []string
+	}{
+		{
+			name: "widths",
+			table: table(`[{"t":"AlignLeft"},{"t":"ColWidth","c":0.25}],[{"t":"AlignRight"},{"t":"ColWidth","c":0.75}]`,
+				row(cell("AlignDefault", 1, 1, "a"), cell("AlignCenter", 1, 1, "b"))),
+			cells: []string{
+				`\startxcell[align=flushleft,width=0.2500\textwidth]`,
+				`\startxcell[align=middle,width=0.7500\textwidth]`,
+			},
+		},
+		{
+			name:  "default widths",
+			table: table(`[{"t":"AlignDefault"},{"t":"ColWidthDefault"}]`, row(cell("AlignDefault", 1, 1, "a"))),
+			cells: []string{`\startxcell`},
+		},
+		{
+			name: "spans",
+			table: table(`[{"t":"AlignLeft"},{"t":"ColWidth","c":0.25}],[{"t":"AlignRight"},{"t":"ColWidth","c":0.5}]`,
+				row(cell("AlignDefault", 1, 2, "a")),
+				row(cell("AlignDefault", 2, 1, "b"), cell("AlignDefault", 1, 1, "c")),
+				row(cell("AlignDefault", 1, 1, "d"))),
+			cells: []string{
+				`\startxcell[nx=2,align=flushleft,width=0.7500\textwidth]`,
+				`\startxcell[ny=2,align=flushleft,width=0.2500\textwidth]`,
+				`\startxcell[align=flushright,width=0.5000\textwidth]`,
+				`\startxcell[align=flushright,width=0.5000\textwidth]`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := convert(t, pandocJSON(tt.table))
+			cells := []string{}
+			for _, line := range strings.Split(out, "\n") {
+				if strings.HasPrefix(line, `\startxcell`) {
+					cells = append(cells, line)
+				}
+			}
+			if !reflect.DeepEqual(cells, tt.cells) {
+				t.Errorf("cells:\n%s\nwant:\n%s", strings.Join(cells, "\n"), strings.Join(tt.cells, "\n"))
+			}
+		})
+	}
+}
+
+func TestLists(t *testing.T) {
+	plain := func(text string) string {
+		return `[{"t":"Plain","c":[{"t":"Str","c":"` + text + `"}]}]`
+	}
+	task := func(box, text string) string {
+		return `[{"t":"Plain","c":[{"t":"Str","c":"` + box + `"},{"t":"Space"},{"t":"Str","c":"` + text + `"}]}]`
+	}
+	ordered := func(start int, style, delim string) string {
+		return `{"t":"OrderedList","c":[[` + strconv.Itoa(start) + `,{"t":"` + style + `"},{"t":"` + delim + `"}],[` + plain("a") + `]]}`
+	}
+	tests := []struct {
+		name string
+		list string
+		want string
+	}{
+		{
+			name: "period",
+			list: ordered(1, "Decimal", "Period"),
+			want: "\\startitemize[n,packed][stopper=.]\n\\item\na\n\\stopitemize",
+		},
+		{
+			name: "one paren",
+			list: ordered(3, "LowerAlpha", "OneParen"),
+			want: "\\startitemize[a,packed][start=3,stopper=)]\n\\item\na\n\\stopitemize",
+		},
+		{
+			name: "two parens",
+			list: ordered(1, "UpperRoman", "TwoParens"),
+			want: "\\startitemize[R,packed][left=(,stopper=)]\n\\item\na\n\\stopitemize",
+		},
+		{
+			name: "default delimiter",
+			list: ordered(1, "DefaultStyle", "DefaultDelim"),
+			want: "\\startitemize[n,packed][stopper=.]\n\\item\na\n\\stopitemize",
+		},
+		{
+			name: "tasks",
+			list: `{"t":"BulletList","c":[` + task("☐", "open") + `,` + task("☒", "done") + `,` + plain("plain") + `]}`,
+			want: "\\startitemize[packed]\n\\sym{$\\square$}\nopen\n\\sym{$\\boxtimes$}\ndone\n\\item\nplain\n\\stopitemize",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := convert(t, pandocJSON(tt.list))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+// inlineImage returns the pandoc JSON of a paragraph with an image that is not
+// placed as a float, with the given key-values.
+func inlineImage(url string, kvs ...string) string {
+	kvs = append([]string{`["placement","inline"]`}, kvs...)
+	return paraJSON(`{"t":"Image","c":[["",[],[` + strings.Join(kvs, ",") + `]],[],["` + url + `",""]]}`)
+}
+
+func TestResourcePath(t *testing.T) {
+	indir, res1, res2 := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, fn := range []string{
+		filepath.Join(indir, "local.png"),
+		filepath.Join(res1, "local.png"),
+		filepath.Join(res1, "shared.png"),
+		filepath.Join(res2, "shared.png"),
+		filepath.Join(res2, "logo.png"),
+		filepath.Join(res2, "logo.pdf"),
+	} {
+		if err := os.WriteFile(fn, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(dir, name string) string { return filepath.ToSlash(filepath.Join(dir, name)) }
+	tests := []struct {
+		name     string
+		url      string
+		want     string
+		warnings int
+	}{
+		{"input directory first", "local.png", path(indir, "local.png"), 0},
+		{"resource paths in order", "shared.png", path(res1, "shared.png"), 0},
+		{"known extensions", "logo", path(res2, "logo.pdf"), 0},
+		{"remote", "https://example.com/a.png", "https://example.com/a.png", 0},
+		{"missing", "missing.png", path(indir, "missing.png"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(inlineImage(tt.url)), func(w *Writer) {
+				w.indir = indir
+				w.ResourcePath = []string{res1, res2}
+			})
+			if want := `\externalfigure[` + tt.want + `]`; !strings.Contains(out, want) {
+				t.Errorf("output does not contain %q:\n%s", want, out)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
+
+func TestImageSizes(t *testing.T) {
+	const url = "https://example.com/a.png"
+	tests := []struct {
+		name   string
+		blocks string
+		dpi    float64
+		want   string
+	}{
+		{"percent width", inlineImage(url, `["width","50%"]`), 0, `width=0.5\textwidth`},
+		{"percent height", inlineImage(url, `["height","25%"]`), 0, `height=0.25\textheight`},
+		{"percent in box", `{"t":"Div","c":[["",[],[]],[` + inlineImage(url, `["width","50%"]`) + `]]}`, 0, `width=0.5\hsize`},
+		{"pixels", inlineImage(url, `["width","192px"]`), 0, `width=2in`},
+		{"no unit", inlineImage(url, `["width","48"]`), 0, `width=0.5in`},
+		{"dpi", inlineImage(url, `["width","150px"]`), 300, `width=0.5in`},
+		{"inch", inlineImage(url, `["width","2inch"]`), 0, `width=2in`},
+		{"centimeters", inlineImage(url, `["height","1.23456cm"]`), 0, `height=1.2346cm`},
+		{"points", inlineImage(url, `["width","72pt"]`), 0, `width=72pt`},
+		{"scale factor", inlineImage(url, `["scale","0.5"]`), 0, `scale=500`},
+		{"scale percent", inlineImage(url, `["scale","125%"]`), 0, `scale=1250`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(tt.blocks), func(w *Writer) {
+				if tt.dpi > 0 {
+					w.ImageDPI = tt.dpi
+				}
+			})
+			if want := "[conversion=mp," + tt.want + "]"; !strings.Contains(out, want) {
+				t.Errorf("output does not contain %q:\n%s", want, out)
+			}
+			if len(w.Warnings) != 0 {
+				t.Errorf("unexpected warnings: %v", w.Warnings)
+			}
+		})
+	}
+
+	for _, kv := range []string{`["width","-1cm"]`, `["height","tall"]`, `["scale","0"]`, `["scale","x%"]`} {
+		_, w := convert(t, pandocJSON(inlineImage(url, kv)))
+		if len(w.Warnings) != 1 {
+			t.Errorf("%s: got %d warnings, want 1: %v", kv, len(w.Warnings), w.Warnings)
+		}
+	}
+}
+
+func TestImageOptions(t *testing.T) {
+	const url = "https://example.com/a.pdf"
+	tests := []struct {
+		name     string
+		kvs      []string
+		want     string
+		warnings int
+	}{
+		{"default", nil, `{\externalfigure[` + url + `][conversion=mp]}`, 0},
+		{"angle", []string{`["angle","90"]`}, `{\rotate[rotation=90]{\externalfigure[` + url + `][conversion=mp]}}`, 0},
+		{"invalid angle", []string{`["angle","left"]`}, `{\externalfigure[` + url + `][conversion=mp]}`, 1},
+		{"no conversion", []string{`["conversion","none"]`}, `{\externalfigure[` + url + `]}`, 0},
+		{"conversion", []string{`["conversion","png"]`}, `{\externalfigure[` + url + `][conversion=png]}`, 0},
+		{"page", []string{`["page","3"]`}, `[conversion=mp,page=3]`, 0},
+		{"invalid page", []string{`["page","0"]`}, `[conversion=mp]`, 1},
+		{"clip", []string{`["clip","true"]`}, `[conversion=mp,size=trim]`, 0},
+		{"clip box", []string{`["clip","crop"]`}, `[conversion=mp,size=crop]`, 0},
+		{"invalid clip", []string{`["clip","some"]`}, `[conversion=mp]`, 1},
+		{"frame", []string{`["frame","on"]`}, `[conversion=mp,frame=on]`, 0},
+		{"background", []string{`["background","gray"]`}, `[conversion=mp,background=color,backgroundcolor=gray]`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(inlineImage(url, tt.kvs...)))
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("output does not contain %q:\n%s", tt.want, out)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
+
+func TestPageInsertion(t *testing.T) {
+	pages := func(url string, kvs string) string {
+		return paraJSON(`{"t":"Image","c":[["",["pages"],[` + kvs + `]],[],["` + url + `",""]]}`)
+	}
+	tests := []struct {
+		name     string
+		image    string
+		want     string
+		warnings int
+	}{
+		{"all", pages("https://example.com/a.pdf", ""), `\copypages[https://example.com/a.pdf]`, 0},
+		{"selection", pages("https://example.com/a.pdf", `["pages","1-3, odd"]`), `\filterpages[https://example.com/a.pdf][1:3,odd]`, 0},
+		{"invalid selection", pages("https://example.com/a.pdf", `["pages","first"]`), `\filterpages[https://example.com/a.pdf][first]`, 1},
+		{"not a pdf", pages("https://example.com/a.png", ""), `\copypages[https://example.com/a.png]`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(tt.image))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
+
+func TestExternalLinks(t *testing.T) {
+	link := func(class, text, url string) string {
+		return paraJSON(`{"t":"Link","c":[["",[` + class + `],[]],[{"t":"Str","c":"` + text + `"}],["` + url + `",""]]}`)
+	}
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{
+			name: "query and fragment",
+			link: link("", "site", "https://example.com/a_b?x=1&y=50%#top"),
+			want: `\goto{site}[url(https://example.com/a_b?x=1\letterampersand y=50\letterpercent \letterhash top)]`,
+		},
+		{
+			name: "reference delimiters",
+			link: link("", "wiki", "https://example.com/Foo_(bar) [1]"),
+			want: `\goto{wiki}[url(https://example.com/Foo_\letterpercent 28bar\letterpercent 29\letterpercent 20\letterpercent 5B1\letterpercent 5D)]`,
+		},
+		{
+			name: "tex specials",
+			link: link("", "home", `https://example.com/~me/{a}$\\b`),
+			want: `\goto{home}[url(https://example.com/\lettertilde me/\letterleftbrace a\letterrightbrace \letterdollar \letterbackslash b)]`,
+		},
+		{
+			name: "autolink",
+			link: link(`"uri"`, "https://example.com/~me", "https://example.com/~me"),
+			want: `\goto{\hyphenatedurl{https://example.com/\lettertilde me}}[url(https://example.com/\lettertilde me)]`,
+		},
+		{
+			name: "email",
+			link: link(`"email"`, "me@example.com", "mailto:me@example.com"),
+			want: `\goto{\hyphenatedurl{me@example.com}}[url(mailto:me@example.com)]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := convert(t, pandocJSON(tt.link))
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentLinks(t *testing.T) {
+	dir := t.TempDir()
+	heading := func(id string) *pandoc.Header {
+		return &pandoc.Header{Level: 1, Attr: pandoc.Attr{Identifier: id}}
+	}
+	path := func(name string) string {
+		fn, err := normalizePath(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	documents := map[string]*Document{
+		path("main.md"):    NewDocument(pandoc.BlockList{heading("intro")}, nil, "main"),
+		path("install.md"): NewDocument(pandoc.BlockList{heading("install-guide"), heading("prerequisites"), heading("setup")}, map[string]bool{"setup": true}, "install"),
+		path("empty.md"):   NewDocument(nil, nil, "empty"),
+	}
+	link := func(text, url string) string {
+		content := ""
+		if text != "" {
+			content = `{"t":"Str","c":"` + text + `"}`
+		}
+		return paraJSON(`{"t":"Link","c":[["",[],[]],[` + content + `],["` + url + `",""]]}`)
+	}
+	tests := []struct {
+		name     string
+		link     string
+		want     string
+		warnings int
+	}{
+		{"fragment", link("Prerequisites", "install.md#prerequisites"), `\goto{Prerequisites}[install:prerequisites]`, 0},
+		{"first heading", link("Install", "install.md"), `\goto{Install}[install:install-guide]`, 0},
+		{"explicit identifier", link("Setup", "install.md#setup"), `\goto{Setup}[setup]`, 0},
+		{"relative path", link("", "sub/../install.md#prerequisites"), `\in[install:prerequisites]`, 0},
+		{"own document", link("Intro", "main.md#intro"), `\goto{Intro}[main:intro]`, 0},
+		{"not in the build", link("Other", "other.md#x"), `\goto{Other}[url(other.md\letterhash x)]`, 1},
+		{"no heading", link("Empty", "empty.md"), `\goto{Empty}[url(empty.md)]`, 1},
+		{"remote", link("Remote", "https://example.com/a.md"), `\goto{Remote}[url(https://example.com/a.md)]`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, w := convert(t, pandocJSON(tt.link), func(w *Writer) {
+				w.indir = dir
+				w.Documents = documents
+				w.Document = documents[path("main.md")]
+			})
+			if out != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out, tt.want)
+			}
+			if len(w.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(w.Warnings), tt.warnings, w.Warnings)
+			}
+		})
+	}
+}
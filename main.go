@@ -18,18 +18,22 @@ func main() {
 
 	app.Version("version", app_version())
 
-	app.Spec = "-w=<WORKDIR> [-t=<TEMPLATE-FILE>] [-d=<var=value>] [-o=<OUTPUT-FILE>] INPUT"
+	app.Spec = "-w=<WORKDIR> [-t=<TEMPLATE-FILE>] [-d=<var=value>] [-o=<OUTPUT-FILE>] [--resource-path=<DIRS>] [--strict] INPUT"
 
 	mainInputFN := ""
 	workdir := ""
 	templateFN := ""
 	outFN := ""
 	definitions := []string{}
+	resourcePath := []string{}
+	strict := false
 
 	app.StringOptPtr(&workdir, "w workdir", "", "a directory for temporary files")
 	app.StringOptPtr(&templateFN, "t template", "", "specify a yaml template file (required for PDF generation)")
 	app.StringsOptPtr(&definitions, "d def", nil, "add definition")
 	app.StringOptPtr(&outFN, "o output", "", "output filename for the generated PDF file (also requires -t flag)")
+	app.StringsOptPtr(&resourcePath, "resource-path", nil, "directories searched for images (separated by '"+string(os.PathListSeparator)+"')")
+	app.BoolOptPtr(&strict, "strict", false, "fail when markdown content can't be fully converted")
 	app.StringArgPtr(&mainInputFN, "INPUT", "", "input file")
 
 	app.Action = func() {
@@ -44,6 +48,7 @@ func main() {
 		}
 
 		prj := context.NewProject(workdir)
+		prj.Strict = strict
 
 		prj.Definitions["fontsize"] = "12pt"
 		prj.Definitions["pagesize"] = "letter"
@@ -55,6 +60,19 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		// command line resource paths are searched before the template ones
+		dirs := []string{}
+		for _, v := range resourcePath {
+			for _, dir := range filepath.SplitList(v) {
+				dir, err = filepath.Abs(dir)
+				if err != nil {
+					log.Fatal(err)
+				}
+				dirs = append(dirs, filepath.ToSlash(dir))
+			}
+		}
+		prj.ResourcePath = append(dirs, prj.ResourcePath...)
 		err = prj.LoadMain(mainInputFN)
 		if err != nil {
 			log.Fatal(err)
@@ -68,11 +86,14 @@ func main() {
 			prj.Definitions[strings.TrimSpace(kv[0])] = kv[1]
 		}
 
-		if v, ok := prj.Layouts[prj.Definitions["pagesize"]]; ok {
-			prj.Definitions["layout"] = v
+		err = prj.ExpandDefinitions()
+		if err != nil {
+			log.Fatal(err)
 		}
-		if _, ok := prj.Definitions["papersize"]; !ok {
-			prj.Definitions["papersize"] = prj.Definitions["pagesize"]
+
+		err = prj.ResolveLayout()
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		err = prj.Process()